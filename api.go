@@ -2,8 +2,13 @@ package main
 
 import (
   "fmt"
+  "io"
+  "errors"
   "net/http"
+  "encoding/base64"
   "encoding/json"
+  "os"
+  "time"
 )
 
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
@@ -18,6 +23,62 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
   fmt.Fprintf(w, "<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", cfg.fileserverHits)
 }
 
+func (cfg *apiConfig) handlerBackup(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-backup-%s.json"`, time.Now().UTC().Format("20060102-150405")))
+  err := cfg.DB.Backup(w)
+  if err != nil {
+    // nothing has been written yet if the snapshot itself failed
+    respondWithError(w, http.StatusInternalServerError, "Couldn't create backup")
+    return
+  }
+}
+
+// handlerRotateKey re-encrypts the database while the server keeps running.
+// the new key comes in the request, or else from DB_ENCRYPTION_NEW_KEY as it
+// was when the server started
+func (cfg *apiConfig) handlerRotateKey(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Key string `json:"key"`
+  }
+  type response struct {
+    KeyID string `json:"key_id"`
+  }
+
+  params := parameters{}
+  err := json.NewDecoder(r.Body).Decode(&params)
+  if err != nil && !errors.Is(err, io.EOF) {
+    respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+    return
+  }
+  newKey := cfg.newEncryptionKey
+  if params.Key != "" {
+    newKey, err = parseEncryptionKey(params.Key)
+    if err != nil {
+      respondWithError(w, http.StatusBadRequest, "key: " + err.Error())
+      return
+    }
+  }
+  if newKey == nil {
+    respondWithError(w, http.StatusBadRequest, "Send the new key as key or set DB_ENCRYPTION_NEW_KEY")
+    return
+  }
+
+  err = cfg.DB.RotateEncryptionKey(newKey)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  // anything in this process that opens the database from now on needs the
+  // new key, the old one no longer unwraps it
+  os.Setenv("DB_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(newKey))
+  os.Unsetenv("DB_ENCRYPTION_NEW_KEY")
+
+  respondWithJSON(w, http.StatusOK, response{
+    KeyID: keyID(newKey),
+  })
+}
+
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     cfg.fileserverHits++
@@ -67,21 +128,29 @@ func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request
     respondWithError(w, http.StatusUnauthorized, err.Error())
     return
   }
+  if user.ID == 0 {
+    respondWithError(w, http.StatusUnauthorized, "Couldn't find user for this refresh token")
+    return
+  }
   if user.RefreshTokenRevokedAt != "" {
     respondWithError(w, http.StatusUnauthorized, "This refresh token was revoked")
     return
   }
+  if user.suspended(now()) {
+    respondWithError(w, http.StatusForbidden, suspensionError(user).Error())
+    return
+  }
 
   // create new token
   // it took me a while to figure out why the tests were failing; 
   // I misunderstood that this "refresh" endpoint should return an access token 
-  newAccessToken, TokenErr := cfg.jwtCreateAccessToken(user.ID)
+  newAccessToken, TokenErr := cfg.jwtCreateAccessToken(user.ID, user.Role)
   if TokenErr != nil {
     respondWithError(w, http.StatusInternalServerError, TokenErr.Error())
     return
   }
 
-  cfg.DB.SetUserTokens(user.ID, user.AccessToken, newAccessToken)
+  cfg.DB.SetUserTokens(user.ID, newAccessToken, user.RefreshToken)
   respondWithJSON(w, http.StatusOK, response{
     Token: newAccessToken,
   })
@@ -105,6 +174,7 @@ func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request)
   _, errR := cfg.DB.RevokeRefreshToken(token)
   if errR != nil {
     respondWithError(w, http.StatusInternalServerError, "Coulnd't find token to revoke")
+    return
   }
 
   respondWithJSON(w, http.StatusOK, "")
@@ -0,0 +1,758 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+  passwordHashCost = bcrypt.MinCost
+  os.Exit(m.Run())
+}
+
+// newTestAPI wires an apiConfig against the in-memory store, so nothing
+// here touches the disk; the word list file does not exist either, which
+// leaves the default rules
+func newTestAPI(t *testing.T) (*apiConfig, http.Handler) {
+  t.Helper()
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  words, err := newWordList("testdata/no_such_words_file.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  cfg := &apiConfig{
+    DB: db,
+    jwtSecret: "test-secret",
+    polkaAPIKey: "test-polka-key",
+    trashRetention: defaultTrashRetention,
+    moderator: moderationPipeline{words},
+    chirpLimits: map[string]int{tierFree: chirpCharLimit, tierRed: redChirpCharLimit},
+  }
+  return cfg, cfg.routes()
+}
+
+func request(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+  t.Helper()
+  r := httptest.NewRequest(method, path, strings.NewReader(body))
+  if token != "" {
+    r.Header.Set("Authorization", "Bearer " + token)
+  }
+  w := httptest.NewRecorder()
+  h.ServeHTTP(w, r)
+  return w
+}
+
+func decodeBody[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+  t.Helper()
+  var v T
+  err := json.Unmarshal(w.Body.Bytes(), &v)
+  if err != nil {
+    t.Fatalf("decoding %q: %s", w.Body.String(), err)
+  }
+  return v
+}
+
+type testTokens struct {
+  ID           int    `json:"id"`
+  Token        string `json:"token"`
+  RefreshToken string `json:"refresh_token"`
+}
+
+// signUp creates a user and logs them in
+func signUp(t *testing.T, h http.Handler, email string) testTokens {
+  t.Helper()
+  body := `{"email": "` + email + `", "password": "hunter2"}`
+  w := request(t, h, "POST", "/api/users", "", body)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating %s: %d %s", email, w.Code, w.Body.String())
+  }
+  w = request(t, h, "POST", "/api/login", "", body)
+  if w.Code != http.StatusOK {
+    t.Fatalf("logging in %s: %d %s", email, w.Code, w.Body.String())
+  }
+  return decodeBody[testTokens](t, w)
+}
+
+// signUpAs signs a user up with role; they log in again to get it into their token
+func signUpAs(t *testing.T, cfg *apiConfig, h http.Handler, email, role string) testTokens {
+  t.Helper()
+  tokens := signUp(t, h, email)
+  _, err := cfg.DB.SetUserRole(tokens.ID, role)
+  if err != nil {
+    t.Fatal(err)
+  }
+  w := request(t, h, "POST", "/api/login", "", `{"email": "` + email + `", "password": "hunter2"}`)
+  if w.Code != http.StatusOK {
+    t.Fatalf("logging in %s again: %d %s", email, w.Code, w.Body.String())
+  }
+  return decodeBody[testTokens](t, w)
+}
+
+func TestChirpLifecycle(t *testing.T) {
+  _, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+
+  w := request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "what a kerfuffle"}`)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating a chirp: %d %s", w.Code, w.Body.String())
+  }
+  chirp := decodeBody[Chirp](t, w)
+  if chirp.Body != "what a ****" || chirp.Author_ID != alice.ID {
+    t.Fatalf("got %+v", chirp)
+  }
+
+  chirps := decodeBody[[]Chirp](t, request(t, h, "GET", "/api/chirps", "", ""))
+  if len(chirps) != 1 || chirps[0].ID != chirp.ID {
+    t.Fatalf("GET /api/chirps = %+v", chirps)
+  }
+
+  w = request(t, h, "DELETE", "/api/chirps/1", alice.Token, "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("deleting: %d %s", w.Code, w.Body.String())
+  }
+  if w := request(t, h, "GET", "/api/chirps/1", "", ""); w.Code != http.StatusNotFound {
+    t.Fatalf("deleted chirp: %d %s", w.Code, w.Body.String())
+  }
+  trash := decodeBody[[]Chirp](t, request(t, h, "GET", "/api/trash", alice.Token, ""))
+  if len(trash) != 1 || trash[0].ID != chirp.ID {
+    t.Fatalf("GET /api/trash = %+v", trash)
+  }
+}
+
+func TestChirpsNeedTheAuthor(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  bob := signUp(t, h, "bob@example.com")
+
+  if w := request(t, h, "POST", "/api/chirps", "", `{"body": "hi"}`); w.Code != http.StatusUnauthorized {
+    t.Fatalf("without a token: %d", w.Code)
+  }
+  request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "hi"}`)
+  if w := request(t, h, "DELETE", "/api/chirps/1", bob.Token, ""); w.Code != http.StatusForbidden {
+    t.Fatalf("deleting someone else's chirp: %d", w.Code)
+  }
+  // signed fine, but not the token alice was last handed
+  other, err := cfg.jwtCreateToken("chirpy-access", 60, alice.ID, roleUser)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if w := request(t, h, "DELETE", "/api/chirps/1", other, ""); w.Code != http.StatusForbidden {
+    t.Fatalf("deleting with a token that is not alice's current one: %d", w.Code)
+  }
+  if w := request(t, h, "DELETE", "/api/chirps/1", alice.Token, ""); w.Code != http.StatusOK {
+    t.Fatalf("deleting as the author: %d %s", w.Code, w.Body.String())
+  }
+  if w := request(t, h, "GET", "/admin/backup", bob.Token, ""); w.Code != http.StatusForbidden {
+    t.Fatalf("backup as a user: %d", w.Code)
+  }
+}
+
+func TestRefreshAndRevoke(t *testing.T) {
+  _, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+
+  w := request(t, h, "POST", "/api/refresh", alice.RefreshToken, "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("refreshing: %d %s", w.Code, w.Body.String())
+  }
+  refreshed := decodeBody[testTokens](t, w)
+  if w := request(t, h, "POST", "/api/chirps", refreshed.Token, `{"body": "hi"}`); w.Code != http.StatusCreated {
+    t.Fatalf("posting with the refreshed token: %d %s", w.Code, w.Body.String())
+  }
+  // only access tokens get you in
+  if w := request(t, h, "POST", "/api/chirps", alice.RefreshToken, `{"body": "hi"}`); w.Code != http.StatusUnauthorized {
+    t.Fatalf("posting with the refresh token: %d", w.Code)
+  }
+
+  request(t, h, "POST", "/api/revoke", alice.RefreshToken, "")
+  if w := request(t, h, "POST", "/api/refresh", alice.RefreshToken, ""); w.Code != http.StatusUnauthorized {
+    t.Fatalf("refreshing a revoked token: %d", w.Code)
+  }
+}
+
+func TestAdminRoutesNeedAnAdmin(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  user := signUp(t, h, "user@example.com")
+  moderator := signUpAs(t, cfg, h, "moderator@example.com", roleModerator)
+  admin := signUpAs(t, cfg, h, "admin@example.com", roleAdmin)
+
+  for _, route := range []string{"GET /admin/backup", "GET /admin/metrics", "GET /admin/no-such-route"} {
+    method, path, _ := strings.Cut(route, " ")
+    if w := request(t, h, method, path, "", ""); w.Code != http.StatusUnauthorized {
+      t.Fatalf("%s without a token: %d", route, w.Code)
+    }
+    if w := request(t, h, method, path, user.Token, ""); w.Code != http.StatusForbidden {
+      t.Fatalf("%s as a user: %d", route, w.Code)
+    }
+  }
+  if w := request(t, h, "GET", "/admin/backup", moderator.Token, ""); w.Code != http.StatusForbidden {
+    t.Fatalf("backup as a moderator: %d", w.Code)
+  }
+  if w := request(t, h, "GET", "/admin/backup", admin.Token, ""); w.Code != http.StatusOK {
+    t.Fatalf("backup as an admin: %d %s", w.Code, w.Body.String())
+  }
+  if w := request(t, h, "GET", "/admin/moderation", moderator.Token, ""); w.Code != http.StatusOK {
+    t.Fatalf("moderation queue as a moderator: %d %s", w.Code, w.Body.String())
+  }
+}
+
+func TestRotateKeyNeedsAnAdmin(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  user := signUp(t, h, "user@example.com")
+  moderator := signUpAs(t, cfg, h, "moderator@example.com", roleModerator)
+  admin := signUpAs(t, cfg, h, "admin@example.com", roleAdmin)
+
+  if w := request(t, h, "POST", "/admin/rotate-key", "", ""); w.Code != http.StatusUnauthorized {
+    t.Fatalf("rotating without a token: %d", w.Code)
+  }
+  for _, tokens := range []testTokens{user, moderator} {
+    if w := request(t, h, "POST", "/admin/rotate-key", tokens.Token, ""); w.Code != http.StatusForbidden {
+      t.Fatalf("rotating as user %d: %d", tokens.ID, w.Code)
+    }
+  }
+  // an admin gets as far as the missing key
+  if w := request(t, h, "POST", "/admin/rotate-key", admin.Token, ""); w.Code != http.StatusBadRequest {
+    t.Fatalf("rotating as an admin without a new key: %d %s", w.Code, w.Body.String())
+  }
+}
+
+func TestRotateKeyFromTheRequest(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  oldKey, newKey := newTestKey(t), newTestKey(t)
+  t.Setenv("DB_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(oldKey))
+  t.Setenv("DB_ENCRYPTION_NEW_KEY", "")
+  cfg, h := newTestAPI(t)
+  db, err := openEncryptedDB(t, path, oldKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cfg.DB = db
+  admin := signUpAs(t, cfg, h, "admin@example.com", roleAdmin)
+
+  w := request(t, h, "POST", "/admin/rotate-key", admin.Token, `{"key": "not a key"}`)
+  if w.Code != http.StatusBadRequest {
+    t.Fatalf("rotating to an invalid key: %d", w.Code)
+  }
+  body := `{"key": "` + base64.StdEncoding.EncodeToString(newKey) + `"}`
+  w = request(t, h, "POST", "/admin/rotate-key", admin.Token, body)
+  if w.Code != http.StatusOK {
+    t.Fatalf("rotating: %d %s", w.Code, w.Body.String())
+  }
+  if got := decodeBody[map[string]string](t, w)["key_id"]; got != keyID(newKey) {
+    t.Fatalf("key_id = %q, want %q", got, keyID(newKey))
+  }
+
+  // the process opens the database with the new key from now on
+  keys, err := loadEncryptionKeys()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(keys) != 1 || keyID(keys[0]) != keyID(newKey) {
+    t.Fatalf("configured keys after rotating = %d keys", len(keys))
+  }
+  db.storage.(*jsonFileStorage).Close()
+  if _, err := openEncryptedDB(t, path, keys...); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestModeratorsOnlySuspendUsersBelowThem(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  user := signUp(t, h, "user@example.com")
+  moderator := signUpAs(t, cfg, h, "moderator@example.com", roleModerator)
+  other := signUpAs(t, cfg, h, "other@example.com", roleModerator)
+  admin := signUpAs(t, cfg, h, "admin@example.com", roleAdmin)
+
+  for _, author := range []testTokens{other, admin} {
+    w := request(t, h, "POST", "/api/chirps", author.Token, `{"body": "hi"}`)
+    chirp := decodeBody[Chirp](t, w)
+    w = request(t, h, "POST", "/admin/moderation/" + strconv.Itoa(chirp.ID), moderator.Token, `{"action": "suspend"}`)
+    if w.Code != http.StatusForbidden {
+      t.Fatalf("suspending user %d as a moderator: %d %s", author.ID, w.Code, w.Body.String())
+    }
+  }
+  if w := request(t, h, "POST", "/api/chirps", other.Token, `{"body": "still here"}`); w.Code != http.StatusCreated {
+    t.Fatalf("the other moderator got suspended: %d %s", w.Code, w.Body.String())
+  }
+
+  w := request(t, h, "POST", "/api/chirps", user.Token, `{"body": "hi"}`)
+  chirp := decodeBody[Chirp](t, w)
+  w = request(t, h, "POST", "/admin/moderation/" + strconv.Itoa(chirp.ID), moderator.Token, `{"action": "suspend"}`)
+  if w.Code != http.StatusOK {
+    t.Fatalf("suspending a user as a moderator: %d %s", w.Code, w.Body.String())
+  }
+}
+
+func TestMentionedTwiceNotifiedOnce(t *testing.T) {
+  _, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  w := request(t, h, "POST", "/api/users", "", `{"email": "bob@example.com", "password": "hunter2", "handle": "bob"}`)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating bob: %d %s", w.Code, w.Body.String())
+  }
+  w = request(t, h, "POST", "/api/login", "", `{"email": "bob@example.com", "password": "hunter2"}`)
+  bob := decodeBody[testTokens](t, w)
+
+  w = request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "@bob hi @bob"}`)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating a chirp: %d %s", w.Code, w.Body.String())
+  }
+  if chirp := decodeBody[Chirp](t, w); len(chirp.Mentions) != 2 {
+    t.Fatalf("mentions = %+v", chirp.Mentions)
+  }
+  unread := decodeBody[struct {
+    UnreadCount int `json:"unread_count"`
+  }](t, request(t, h, "GET", "/api/notifications/unread_count", bob.Token, ""))
+  if unread.UnreadCount != 1 {
+    t.Fatalf("bob has %d unread notifications, want 1", unread.UnreadCount)
+  }
+}
+
+func TestTokensOfUnknownUsersAreRefused(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  // signed with the right secret, but nobody has id 99
+  token, err := cfg.jwtCreateAccessToken(99, roleUser)
+  if err != nil {
+    t.Fatal(err)
+  }
+  w := request(t, h, "PUT", "/api/users", token, `{"email": "ghost@example.com", "password": "hunter2"}`)
+  if w.Code != http.StatusUnauthorized {
+    t.Fatalf("updating a user that does not exist: %d %s", w.Code, w.Body.String())
+  }
+}
+
+func TestModerationFlagsOnlyInTheQueue(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  path := filepath.Join(t.TempDir(), "words.txt")
+  err := os.WriteFile(path, []byte("sharbert flag\n"), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  words, err := newWordList(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cfg.moderator = moderationPipeline{words}
+  alice := signUp(t, h, "alice@example.com")
+  moderator := signUpAs(t, cfg, h, "moderator@example.com", roleModerator)
+
+  w := request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "a sharbert"}`)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating a chirp: %d %s", w.Code, w.Body.String())
+  }
+  for _, w := range []*httptest.ResponseRecorder{w, request(t, h, "GET", "/api/chirps/1", "", "")} {
+    if strings.Contains(w.Body.String(), "flag") {
+      t.Fatalf("flags went out with the chirp: %s", w.Body.String())
+    }
+  }
+
+  queue := decodeBody[[]struct {
+    Chirp Chirp    `json:"chirp"`
+    Flags []string `json:"flags"`
+  }](t, request(t, h, "GET", "/admin/moderation", moderator.Token, ""))
+  if len(queue) != 1 || queue[0].Chirp.ID != 1 || len(queue[0].Flags) != 1 {
+    t.Fatalf("GET /admin/moderation = %+v", queue)
+  }
+}
+
+func TestRetriedWebhooksApplyOnce(t *testing.T) {
+  _, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  webhook := func(id, event string) {
+    t.Helper()
+    body := `{"id": "` + id + `", "event": "` + event + `", "data": {"user_id": ` + strconv.Itoa(alice.ID) + `}}`
+    r := httptest.NewRequest("POST", "/api/polka/webhooks", strings.NewReader(body))
+    r.Header.Set("Authorization", "ApiKey test-polka-key")
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+    if w.Code != http.StatusOK {
+      t.Fatalf("%s %s: %d %s", event, id, w.Code, w.Body.String())
+    }
+  }
+  type subscription struct {
+    ExpiresAt time.Time         `json:"expires_at"`
+    History   []json.RawMessage `json:"history"`
+  }
+
+  webhook("evt_1", polkaUserUpgraded)
+  webhook("evt_2", polkaUserRenewed)
+  once := decodeBody[subscription](t, request(t, h, "GET", "/api/subscription", alice.Token, ""))
+  // Polka didn't get our 200 and sends the renewal again
+  webhook("evt_2", polkaUserRenewed)
+  again := decodeBody[subscription](t, request(t, h, "GET", "/api/subscription", alice.Token, ""))
+  if !again.ExpiresAt.Equal(once.ExpiresAt) || len(again.History) != 2 {
+    t.Fatalf("after the retry: expires %s (was %s), %d events", again.ExpiresAt, once.ExpiresAt, len(again.History))
+  }
+}
+
+// readPages follows the Link headers from path and returns every page's ids
+func readPages(t *testing.T, h http.Handler, path string) [][]int {
+  t.Helper()
+  pages := [][]int{}
+  for path != "" {
+    w := request(t, h, "GET", path, "", "")
+    if w.Code != http.StatusOK {
+      t.Fatalf("GET %s: %d %s", path, w.Code, w.Body.String())
+    }
+    pages = append(pages, chirpIDs(decodeBody[[]Chirp](t, w)))
+    path = ""
+    if link := w.Header().Get("Link"); link != "" {
+      url, rel, ok := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+      if !ok || rel != `; rel="next"` {
+        t.Fatalf("malformed Link header %q", link)
+      }
+      path = url
+    }
+    if len(pages) > 10 {
+      t.Fatal("pages never end")
+    }
+  }
+  return pages
+}
+
+func TestChirpPagesFollowTheirCursors(t *testing.T) {
+  _, h := newTestAPI(t)
+  author := signUp(t, h, "alice@example.com")
+  for i := 1; i <= 5; i++ {
+    request(t, h, "POST", "/api/chirps", author.Token, `{"body": "chirp `+strconv.Itoa(i)+`"}`)
+  }
+
+  cases := []struct {
+    query string
+    want  [][]int
+  }{
+    {"sort=asc&limit=2", [][]int{{1, 2}, {3, 4}, {5}}},
+    {"sort=desc&limit=2", [][]int{{5, 4}, {3, 2}, {1}}},
+    {"sort=-created_at&limit=3", [][]int{{5, 4, 3}, {2, 1}}},
+    {"sort=asc&limit=5", [][]int{{1, 2, 3, 4, 5}}},
+    // no limit and no cursor is everything, the way it was before pages
+    {"sort=asc", [][]int{{1, 2, 3, 4, 5}}},
+  }
+  for _, c := range cases {
+    t.Run(c.query, func(t *testing.T) {
+      pages := readPages(t, h, "/api/chirps?"+c.query)
+      if fmt.Sprint(pages) != fmt.Sprint(c.want) {
+        t.Fatalf("pages = %v, want %v", pages, c.want)
+      }
+    })
+  }
+
+  // the Link keeps the other parameters and only moves the cursor
+  w := request(t, h, "GET", "/api/chirps?sort=desc&limit=2&author_id=1", "", "")
+  link := w.Header().Get("Link")
+  if !strings.Contains(link, "author_id=1") || !strings.Contains(link, "sort=desc") || !strings.Contains(link, "limit=2") {
+    t.Fatalf("Link = %q", link)
+  }
+  // the cursor encodes the last key handed out
+  cursor, err := decodeCursor(strings.SplitN(strings.SplitN(link, "cursor=", 2)[1], "&", 2)[0])
+  if err != nil || cursor.Sort != "desc" || cursor.ID != 4 || cursor.Time.IsZero() {
+    t.Fatalf("cursor in the Link = %+v, %v", cursor, err)
+  }
+}
+
+func TestChirpPagesSurviveChangesBetweenRequests(t *testing.T) {
+  _, h := newTestAPI(t)
+  author := signUp(t, h, "alice@example.com")
+  for i := 1; i <= 4; i++ {
+    request(t, h, "POST", "/api/chirps", author.Token, `{"body": "chirp `+strconv.Itoa(i)+`"}`)
+  }
+  w := request(t, h, "GET", "/api/chirps?sort=asc&limit=2", "", "")
+  next := strings.TrimSuffix(strings.TrimPrefix(w.Header().Get("Link"), "<"), `>; rel="next"`)
+
+  // the first page's last chirp is deleted and a new one is added;
+  // an offset would now skip chirp 3
+  request(t, h, "DELETE", "/api/chirps/2", author.Token, "")
+  request(t, h, "POST", "/api/chirps", author.Token, `{"body": "chirp 5"}`)
+  if pages := readPages(t, h, next); fmt.Sprint(pages) != "[[3 4] [5]]" {
+    t.Fatalf("pages after the changes = %v", pages)
+  }
+}
+
+func TestInvalidCursorsAreRefused(t *testing.T) {
+  _, h := newTestAPI(t)
+  author := signUp(t, h, "alice@example.com")
+  request(t, h, "POST", "/api/chirps", author.Token, `{"body": "hi"}`)
+
+  descCursor := encodeCursor(pageCursor{Sort: "desc", ID: 1})
+  tampered := []byte(encodeCursor(pageCursor{Sort: "asc", ID: 1}))
+  tampered[len(tampered)/2] ^= 0x20
+  cases := map[string]string{
+    "not base64": "cursor=!!!",
+    "not json": "cursor=" + base64.RawURLEncoding.EncodeToString([]byte("not json")),
+    "tampered": "cursor=" + string(tampered),
+    "from another sort": "sort=asc&cursor=" + descCursor,
+    "zero limit": "limit=0",
+    "negative limit": "limit=-1",
+    "limit not a number": "limit=ten",
+  }
+  for name, query := range cases {
+    t.Run(name, func(t *testing.T) {
+      w := request(t, h, "GET", "/api/chirps?"+query, "", "")
+      if w.Code != http.StatusBadRequest {
+        t.Fatalf("GET /api/chirps?%s: %d %s", query, w.Code, w.Body.String())
+      }
+    })
+  }
+}
+
+func TestChirpPagesWithTiedCreationTimes(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  author := signUp(t, h, "alice@example.com")
+  for i := 1; i <= 5; i++ {
+    request(t, h, "POST", "/api/chirps", author.Token, `{"body": "chirp `+strconv.Itoa(i)+`"}`)
+  }
+  // 2, 3 and 4 were posted in the same instant
+  tied := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+  err := cfg.DB.Update(func(tx *Tx) error {
+    for id := 1; id <= 5; id++ {
+      chirp, _ := tx.Chirp(id)
+      chirp.CreatedAt = tied
+      if id == 1 {
+        chirp.CreatedAt = tied.Add(-time.Minute)
+      }
+      if id == 5 {
+        chirp.CreatedAt = tied.Add(time.Minute)
+      }
+      err := tx.PutChirp(chirp)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // the id breaks the tie, so a page boundary inside it neither skips nor
+  // repeats, whatever order the chirps come out of the map in
+  for i := 0; i < 5; i++ {
+    if pages := readPages(t, h, "/api/chirps?sort=created_at&limit=2"); fmt.Sprint(pages) != "[[1 2] [3 4] [5]]" {
+      t.Fatalf("oldest first = %v", pages)
+    }
+    if pages := readPages(t, h, "/api/chirps?sort=-created_at&limit=2"); fmt.Sprint(pages) != "[[5 4] [3 2] [1]]" {
+      t.Fatalf("newest first = %v", pages)
+    }
+  }
+}
+
+func TestLikingIsIdempotent(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  bob := signUp(t, h, "bob@example.com")
+  carol := signUp(t, h, "carol@example.com")
+  w := request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "like me"}`)
+  path := "/api/chirps/" + strconv.Itoa(decodeBody[Chirp](t, w).ID) + "/like"
+
+  likes := func(method string, tokens testTokens) int {
+    t.Helper()
+    w := request(t, h, method, path, tokens.Token, "")
+    if w.Code != http.StatusOK {
+      t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body.String())
+    }
+    return decodeBody[Chirp](t, w).LikeCount
+  }
+  if n := likes("POST", bob); n != 1 {
+    t.Fatalf("like count after bob liked = %d", n)
+  }
+  if n := likes("POST", bob); n != 1 {
+    t.Fatalf("like count after bob liked again = %d", n)
+  }
+  if n := likes("POST", carol); n != 2 {
+    t.Fatalf("like count after carol liked = %d", n)
+  }
+  // liking twice notifies once
+  if notifications, _ := cfg.DB.GetNotifications(alice.ID); len(notifications) != 2 {
+    t.Fatalf("alice has %d notifications, want 2", len(notifications))
+  }
+  w = request(t, h, "GET", "/api/users/"+strconv.Itoa(bob.ID)+"/likes", "", "")
+  if liked := decodeBody[[]Chirp](t, w); len(liked) != 1 {
+    t.Fatalf("bob's likes = %v", chirpIDs(liked))
+  }
+
+  if n := likes("DELETE", bob); n != 1 {
+    t.Fatalf("like count after bob unliked = %d", n)
+  }
+  if n := likes("DELETE", bob); n != 1 {
+    t.Fatalf("like count after bob unliked again = %d", n)
+  }
+  if n := likes("DELETE", carol); n != 0 {
+    t.Fatalf("like count after carol unliked = %d", n)
+  }
+  w = request(t, h, "GET", "/api/users/"+strconv.Itoa(bob.ID)+"/likes", "", "")
+  if liked := decodeBody[[]Chirp](t, w); len(liked) != 0 {
+    t.Fatalf("bob's likes after unliking = %v", chirpIDs(liked))
+  }
+  // and it can be liked again
+  if n := likes("POST", bob); n != 1 {
+    t.Fatalf("like count after bob liked once more = %d", n)
+  }
+}
+
+func TestEditingKeepsHistoryAndNeedsChirpyRed(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  bob := signUp(t, h, "bob@example.com")
+  w := request(t, h, "POST", "/api/chirps", alice.Token, `{"body": "first #draft"}`)
+  chirp := decodeBody[Chirp](t, w)
+  path := "/api/chirps/" + strconv.Itoa(chirp.ID)
+
+  // free users can't edit
+  if w := request(t, h, "PUT", path, alice.Token, `{"body": "second"}`); w.Code != http.StatusForbidden {
+    t.Fatalf("editing on the free plan: %d %s", w.Code, w.Body.String())
+  }
+  for _, user := range []testTokens{alice, bob} {
+    _, err := cfg.DB.ApplySubscriptionEvent(user.ID, polkaUserUpgraded, "", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  // nor can anyone but the author
+  if w := request(t, h, "PUT", path, bob.Token, `{"body": "mine now"}`); w.Code != http.StatusForbidden {
+    t.Fatalf("editing someone else's chirp: %d %s", w.Code, w.Body.String())
+  }
+
+  for _, body := range []string{"second #edit", "third"} {
+    w := request(t, h, "PUT", path, alice.Token, `{"body": "`+body+`"}`)
+    if w.Code != http.StatusOK {
+      t.Fatalf("editing to %q: %d %s", body, w.Code, w.Body.String())
+    }
+  }
+  edited := decodeBody[Chirp](t, request(t, h, "GET", path, "", ""))
+  if edited.Body != "third" || edited.EditedAt == nil || len(edited.Tags) != 0 || !edited.CreatedAt.Equal(chirp.CreatedAt) {
+    t.Fatalf("chirp after editing = %+v", edited)
+  }
+
+  revisions := decodeBody[[]Revision](t, request(t, h, "GET", path+"/revisions", "", ""))
+  if len(revisions) != 2 || revisions[0].Body != "first #draft" || revisions[1].Body != "second #edit" {
+    t.Fatalf("revisions = %+v", revisions)
+  }
+  if fmt.Sprint(revisions[0].Tags) != "[draft]" || fmt.Sprint(revisions[1].Tags) != "[edit]" {
+    t.Fatalf("revision tags = %v, %v", revisions[0].Tags, revisions[1].Tags)
+  }
+  // each version was posted when the one before it was replaced
+  if !revisions[0].CreatedAt.Equal(chirp.CreatedAt) || !revisions[1].CreatedAt.Equal(revisions[0].ReplacedAt) || !revisions[1].ReplacedAt.Equal(*edited.EditedAt) {
+    t.Fatalf("revision times = %+v", revisions)
+  }
+
+  _, err := cfg.DB.ApplySubscriptionEvent(alice.ID, polkaUserDowngraded, "", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if w := request(t, h, "PUT", path, alice.Token, `{"body": "fourth"}`); w.Code != http.StatusForbidden {
+    t.Fatalf("editing after downgrading: %d %s", w.Code, w.Body.String())
+  }
+}
+
+func TestPublishedDraftsKeepTheirID(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  post := func(body string) Chirp {
+    t.Helper()
+    w := request(t, h, "POST", "/api/chirps", alice.Token, body)
+    if w.Code != http.StatusCreated {
+      t.Fatalf("posting %s: %d %s", body, w.Code, w.Body.String())
+    }
+    return decodeBody[Chirp](t, w)
+  }
+  post(`{"body": "one"}`)
+  draft := post(`{"body": "two", "draft": true}`)
+  scheduled := post(`{"body": "three", "publish_at": "` + now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+  post(`{"body": "four"}`)
+  post(`{"body": "five"}`)
+
+  w := request(t, h, "GET", "/api/chirps?sort=asc&limit=2", "", "")
+  if ids := chirpIDs(decodeBody[[]Chirp](t, w)); fmt.Sprint(ids) != "[1 4]" {
+    t.Fatalf("first page = %v", ids)
+  }
+  next := strings.TrimSuffix(strings.TrimPrefix(w.Header().Get("Link"), "<"), `>; rel="next"`)
+
+  w = request(t, h, "PUT", "/api/drafts/"+strconv.Itoa(draft.ID), alice.Token, `{"draft": false}`)
+  if published := decodeBody[Chirp](t, w); w.Code != http.StatusOK || published.ID != draft.ID || published.Status != chirpPublished {
+    t.Fatalf("publishing the draft: %d %s", w.Code, w.Body.String())
+  }
+  if n, err := cfg.DB.PublishDue(now().Add(2 * time.Hour)); err != nil || n != 1 {
+    t.Fatalf("PublishDue = %d, %v", n, err)
+  }
+  // nothing is published twice
+  if n, err := cfg.DB.PublishDue(now().Add(2 * time.Hour)); err != nil || n != 0 {
+    t.Fatalf("PublishDue again = %d, %v", n, err)
+  }
+  if w := request(t, h, "GET", "/api/chirps/"+strconv.Itoa(scheduled.ID), "", ""); w.Code != http.StatusOK {
+    t.Fatalf("the scheduled chirp under its id: %d", w.Code)
+  }
+
+  // both come after the page the client already has, in the order they
+  // were published, rather than behind it where their ids would put them
+  if pages := readPages(t, h, next); fmt.Sprint(pages) != "[[5 2] [3]]" {
+    t.Fatalf("pages after publishing = %v", pages)
+  }
+  if pages := readPages(t, h, "/api/chirps?sort=desc&limit=3"); fmt.Sprint(pages) != "[[3 2 5] [4 1]]" {
+    t.Fatalf("newest first = %v", pages)
+  }
+}
+
+func TestRoleClaimFollowsTheUsersRole(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  user := signUp(t, h, "user@example.com")
+  moderator := signUpAs(t, cfg, h, "moderator@example.com", roleModerator)
+
+  for _, c := range []struct {
+    tokens testTokens
+    role   string
+  }{{user, roleUser}, {moderator, roleModerator}} {
+    claims, err := ParseClaims(c.tokens.Token, cfg.jwtSecret)
+    if err != nil || claims.Role != c.role || claims.Issuer != "chirpy-access" {
+      t.Fatalf("claims of user %d = %+v, %v", c.tokens.ID, claims, err)
+    }
+  }
+  // refresh tokens don't say
+  if claims, _ := ParseClaims(user.RefreshToken, cfg.jwtSecret); claims.Role != "" {
+    t.Fatalf("refresh token has role %q", claims.Role)
+  }
+  if w := request(t, h, "GET", "/admin/moderation", moderator.Token, ""); w.Code != http.StatusOK {
+    t.Fatalf("moderator on a moderator route: %d %s", w.Code, w.Body.String())
+  }
+
+  // the old token still says moderator, but it is no longer theirs
+  _, err := cfg.DB.SetUserRole(moderator.ID, roleUser)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if w := request(t, h, "GET", "/admin/moderation", moderator.Token, ""); w.Code != http.StatusUnauthorized {
+    t.Fatalf("stale moderator token on a moderator route: %d", w.Code)
+  }
+  if w := request(t, h, "POST", "/api/chirps", moderator.Token, `{"body": "hi"}`); w.Code != http.StatusUnauthorized {
+    t.Fatalf("stale token on a user route: %d", w.Code)
+  }
+
+  // a refreshed token carries the new role
+  w := request(t, h, "POST", "/api/refresh", moderator.RefreshToken, "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("refreshing: %d %s", w.Code, w.Body.String())
+  }
+  token := decodeBody[testTokens](t, w).Token
+  if claims, _ := ParseClaims(token, cfg.jwtSecret); claims.Role != roleUser {
+    t.Fatalf("refreshed token has role %q", claims.Role)
+  }
+  if w := request(t, h, "GET", "/admin/moderation", token, ""); w.Code != http.StatusForbidden {
+    t.Fatalf("demoted moderator on a moderator route: %d", w.Code)
+  }
+  if w := request(t, h, "POST", "/api/chirps", token, `{"body": "hi"}`); w.Code != http.StatusCreated {
+    t.Fatalf("refreshed token on a user route: %d %s", w.Code, w.Body.String())
+  }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "time"
+)
+
+// backupArchive is a point-in-time copy of the whole database.
+// the checksum covers data exactly as it appears in the archive
+type backupArchive struct {
+  SchemaVersion int             `json:"schema_version"`
+  CreatedAt     time.Time       `json:"created_at"`
+  Checksum      string          `json:"checksum"`
+  Data          json.RawMessage `json:"data"`
+}
+
+// latestSchemaVersion is the schema this build reads and writes; it moves
+// with the migrations so json and sqlite databases share one version number
+func latestSchemaVersion() int {
+  return migrations[len(migrations)-1].version
+}
+
+func checksum(dat []byte) string {
+  sum := sha256.Sum256(dat)
+  return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Backup writes a consistent archive of the database to w;
+// it holds the read lock while copying, so writers wait but readers don't
+func (db *DB) Backup(w io.Writer) error {
+  archive := backupArchive{}
+  err := db.View(func(tx *Tx) error {
+    dat, err := json.Marshal(tx.db.data)
+    if err != nil {
+      return err
+    }
+    archive = backupArchive{
+      SchemaVersion: latestSchemaVersion(),
+      CreatedAt: time.Now().UTC(),
+      Checksum: checksum(dat),
+      Data: dat,
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  return json.NewEncoder(w).Encode(archive)
+}
+
+// Restore replaces everything in the database with the archive read from r,
+// after checking that it is intact and not from a newer version of chirpy.
+// an archive from an older version is backfilled like a database opened by it
+func (db *DB) Restore(r io.Reader) error {
+  archive := backupArchive{}
+  err := json.NewDecoder(r).Decode(&archive)
+  if err != nil {
+    return fmt.Errorf("couldn't read backup: %w", err)
+  }
+  if archive.SchemaVersion > latestSchemaVersion() {
+    return fmt.Errorf("backup has schema version %d, this chirpy only knows up to %d", archive.SchemaVersion, latestSchemaVersion())
+  }
+  if archive.Data == nil || checksum(archive.Data) != archive.Checksum {
+    return errors.New("backup checksum does not match, refusing to restore")
+  }
+
+  dbStructure := newDBStructure()
+  err = json.Unmarshal(archive.Data, &dbStructure)
+  if err != nil {
+    return fmt.Errorf("couldn't decode backup data: %w", err)
+  }
+
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  err = db.storage.replace(dbStructure)
+  if err != nil {
+    return err
+  }
+  db.data = dbStructure
+  db.data.attachChirpFlags()
+  db.idx = buildIndexes(&db.data)
+  return db.update(backfill)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func TestBackupRestoresIntoAnotherDB(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one", "two #go")
+  buf := bytes.Buffer{}
+  err = db.Backup(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  restored, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  restored.CreateUser("bob@example.com", "hunter2")
+  err = restored.Restore(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if user, err := restored.FindUserByEmail("alice@example.com"); err != nil || user.ID != author.ID {
+    t.Fatalf("alice after restoring = %+v, %v", user, err)
+  }
+  // FindUserByEmail hands back an empty user when there is no match
+  if bob, _ := restored.FindUserByEmail("bob@example.com"); bob.ID != 0 {
+    t.Fatal("restoring kept a user that is not in the backup")
+  }
+  chirps, _ := restored.GetChirps()
+  if len(chirps) != 2 {
+    t.Fatalf("chirps after restoring = %v", chirpIDs(chirps))
+  }
+  // sequences come along too, so ids keep counting from the backup
+  if three := createChirps(t, restored, author, "three")[0]; three.ID != 3 {
+    t.Fatalf("first chirp after restoring got id %d", three.ID)
+  }
+}
+
+// archiveOf builds a backup of dat the way Backup would have at version
+func archiveOf(t *testing.T, version int, dat string) *bytes.Buffer {
+  t.Helper()
+  buf := bytes.Buffer{}
+  err := json.NewEncoder(&buf).Encode(backupArchive{
+    SchemaVersion: version,
+    Checksum: checksum([]byte(dat)),
+    Data: json.RawMessage(dat),
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return &buf
+}
+
+func TestRestoreBackfillsOlderArchives(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  // from before chirp statuses and subscriptions
+  old := `{"chirps":{"1":{"body":"old #Chirp","id":1,"author_id":1}},` +
+    `"users":{"1":{"email":"alice@example.com","id":1,"is_chirpy_red":true}}}`
+  err = db.Restore(archiveOf(t, 1, old))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  chirp, err := db.GetChirp(1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if chirp.Status != chirpPublished || chirp.CreatedAt.IsZero() || len(chirp.Tags) != 1 {
+    t.Fatalf("restored chirp was not backfilled: %+v", chirp)
+  }
+  user, err := db.GetUser(1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if user.IsChirpyRed || user.Subscription.Plan != planRed || user.Role != roleUser {
+    t.Fatalf("restored user was not backfilled: %+v", user)
+  }
+}
+
+func TestRestoreRefusesBadArchives(t *testing.T) {
+  dat := `{"users":{"1":{"email":"mallory@example.com","id":1}}}`
+  tampered := archiveOf(t, latestSchemaVersion(), dat)
+  tampered = bytes.NewBufferString(strings.Replace(tampered.String(), "mallory", "mallorx", 1))
+
+  cases := []struct {
+    name    string
+    archive *bytes.Buffer
+    err     string
+  }{
+    {"checksum mismatch", tampered, "checksum does not match"},
+    {"newer schema", archiveOf(t, latestSchemaVersion()+1, dat), "schema version"},
+  }
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      db, err := NewMemoryDB()
+      if err != nil {
+        t.Fatal(err)
+      }
+      db.CreateUser("alice@example.com", "hunter2")
+      err = db.Restore(c.archive)
+      if err == nil || !strings.Contains(err.Error(), c.err) {
+        t.Fatalf("Restore = %v, want an error about %q", err, c.err)
+      }
+      // nothing was replaced
+      if alice, _ := db.FindUserByEmail("alice@example.com"); alice.ID != 1 {
+        t.Fatal("alice is gone after a refused restore")
+      }
+    })
+  }
+}
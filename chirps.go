@@ -2,65 +2,96 @@ package main
 
 import (
   "encoding/json"
+  "fmt"
   "net/http"
   "errors"
   "strings"
-  "sort"
   "strconv"
+  "time"
 )
 
-func getCleanedBody(body string, badWords map[string]struct{}) string {
-  words := strings.Split(body, " ")
-  for i, word := range words {
-    loweredWord := strings.ToLower(word)
-    if _, ok := badWords[loweredWord]; ok {
-      words[i] = "****"
-    }
+// validateChirp checks body against the length limit of the author's tier
+// and runs it through the moderation pipeline
+func (cfg *apiConfig) validateChirp(body string, author User) (Moderation, error) {
+  limit := cfg.chirpLimit(author)
+  if length := chirpLength(body); length > limit {
+    return Moderation{}, fmt.Errorf("Chirp is too long: %d characters, the limit is %d", length, limit)
   }
-  cleaned := strings.Join(words, " ")
-  return cleaned
-}
 
-func validateChirp(body string) (string, error) {
-  const maxChirpLength = 140
-  if len(body) > maxChirpLength {
-    return "", errors.New("Chirp is too long")
-  }
-
-  badWords := map[string]struct{}{
-    "kerfuffle": {},
-    "sharbert":  {},
-    "fornax":    {},
+  moderation := Moderation{Body: body}
+  err := cfg.moderator.Moderate(&moderation)
+  if err != nil {
+    return Moderation{}, err
   }
-  cleaned := getCleanedBody(body, badWords)
-  return cleaned, nil
+  return moderation, nil
 }
 
+// validateToken returns the bearer token of r if it is a tokenType token
+// of a user that may still use it
 func (cfg *apiConfig) validateToken(r *http.Request, tokenType string) (string, error) {
+  token, _, err := cfg.validateTokenClaims(r, tokenType)
+  return token, err
+}
 
+// validateTokenClaims is validateToken for callers that need the claims too;
+// the token is only parsed once
+func (cfg *apiConfig) validateTokenClaims(r *http.Request, tokenType string) (string, chirpyClaims, error) {
   token, err := GetBearerToken(r.Header)
   if err != nil {
-    return "", err
+    return "", chirpyClaims{}, err
+  }
+  claims, err := ParseClaims(token, cfg.jwtSecret)
+  if err != nil {
+    return "", chirpyClaims{}, errors.New("could not validate token")
   }
-  _, errS := ValidateJWT(token, cfg.jwtSecret)
-  if errS != nil {
-    return "", errors.New("could not validate token")
+  if claims.Issuer != tokenType {
+    return "", chirpyClaims{}, errors.New("wrong token type")
   }
 
-  issuer, errI := GetIssuer(token, cfg.jwtSecret)
-  if errI != nil {
-    return "", errors.New("could not validate Issuer")
+  // tokens handed out before a suspension are still signed fine, and so
+  // are those of users that are gone
+  userId, err := strconv.Atoi(claims.Subject)
+  if err != nil {
+    return "", chirpyClaims{}, errors.New("could not validate token")
   }
-  if issuer != tokenType {
-    return "", errors.New("wrong token type")
+  user, err := cfg.DB.GetUser(userId)
+  if err != nil {
+    return "", chirpyClaims{}, errors.New("could not validate token")
+  }
+  if user.suspended(now()) {
+    return "", chirpyClaims{}, suspensionError(user)
   }
 
-  return token, nil
+  return token, claims, nil
+}
+
+// authenticatedUser returns the user whose access token came with r
+func (cfg *apiConfig) authenticatedUser(r *http.Request) (User, error) {
+  user, _, err := cfg.authenticatedUserClaims(r)
+  return user, err
+}
+
+// authenticatedUserClaims also returns the claims of the access token
+func (cfg *apiConfig) authenticatedUserClaims(r *http.Request) (User, chirpyClaims, error) {
+  token, claims, err := cfg.validateTokenClaims(r, "chirpy-access")
+  if err != nil {
+    return User{}, chirpyClaims{}, err
+  }
+
+  user, err := cfg.DB.FindUserByAccessToken(token)
+  if err != nil || user.ID == 0 {
+    return User{}, chirpyClaims{}, errors.New("Cannot find user with this token")
+  }
+  return user, claims, nil
 }
 
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
   type parameters struct {
     Body string `json:"body"`
+    InReplyTo int `json:"in_reply_to"`
+    // drafts and chirps with a publish_at in the future only show up in GET /api/drafts
+    Draft bool `json:"draft"`
+    PublishAt *time.Time `json:"publish_at"`
   }
 
   decoder := json.NewDecoder(r.Body)
@@ -71,35 +102,74 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
     return
   }
 
-  msgCleaned, err := validateChirp(params.Body)
+  user, errU := cfg.authenticatedUser(r)
+  if errU != nil {
+    respondWithError(w, http.StatusUnauthorized, errU.Error())
+    return
+  }
+
+  moderation, err := cfg.validateChirp(params.Body, user)
   if err != nil {
     respondWithError(w, http.StatusBadRequest, err.Error())
     return
   }
 
-  token, errToken := cfg.validateToken(r, "chirpy-access")
-  if errToken != nil {
-    respondWithError(w, http.StatusUnauthorized, errToken.Error())
+  newChirp := Chirp{
+    Body: moderation.Body,
+    Tags: extractHashtags(moderation.Body),
+    InReplyTo: params.InReplyTo,
+    ModerationFlags: moderation.Flags,
   }
-
-  user, errU := cfg.DB.FindUserByAccessToken(token)
-  if errU != nil {
-    respondWithError(w, http.StatusUnauthorized, "Cannot find user with this token")
+  newChirp.schedule(params.Draft, params.PublishAt)
+  chirp, err := cfg.DB.CreateChirp(newChirp, user)
+  if errors.Is(err, errParentNotFound) {
+    respondWithError(w, http.StatusBadRequest, err.Error())
     return
   }
-
-  chirp, err := cfg.DB.CreateChirp(msgCleaned, user)
   if err != nil {
     respondWithError(w, http.StatusInternalServerError, "Could not create chirp")
     return
   }
 
-  respondWithJSON(w, http.StatusCreated, Chirp{
-    Body: chirp.Body,
-    ID:   chirp.ID,
-    Author_ID: user.ID,
-  })
+  respondWithJSON(w, http.StatusCreated, chirp)
+}
+// chirpSortOrders are the orders GET /api/chirps understands: oldest first
+// ("asc", "created_at") or newest first ("desc", "-created_at").
+// a draft keeps the id it got when it was written but is created_at when it
+// is published, so ids are only the tie-breaker; going by id alone would
+// slip a published draft in behind a client that already paged past it.
+// each compares sort keys, so the same function orders chirps and positions cursors
+var chirpSortOrders = map[string]func(a, b pageCursor) bool{
+  "asc": timeAscending,
+  "desc": timeDescending,
+  "created_at": timeAscending,
+  "-created_at": timeDescending,
+}
+
+func chirpSortKey(sortOrder string) func(Chirp) pageCursor {
+  return func(chirp Chirp) pageCursor {
+    return pageCursor{Sort: sortOrder, Time: chirp.CreatedAt, ID: chirp.ID}
+  }
+}
+
+// paginateChirps sorts chirps and cuts out the page asked for in r,
+// setting the Link header for the next one
+func paginateChirps(w http.ResponseWriter, r *http.Request, chirps []Chirp, sortOrder string) ([]Chirp, error) {
+  less, ok := chirpSortOrders[sortOrder]
+  if !ok {
+    return nil, errors.New("unknown sort order")
+  }
+  params, err := parsePageParams(r, sortOrder)
+  if err != nil {
+    return nil, err
+  }
+
+  sortBy(chirps, chirpSortKey(sortOrder), less)
+  page, next := paginate(chirps, params, chirpSortKey(sortOrder), less)
+  setNextLink(w, r, params, next)
+  return page, nil
 }
+
 func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Request) {
   // get sort order string if it exists 
   sortOrder := r.URL.Query().Get("sort")
@@ -113,46 +183,52 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
     authorId = 0
   }
 
-  dbChirps, err := cfg.DB.GetChirps()
+  var dbChirps []Chirp
+  if authorId == 0 {
+    dbChirps, err = cfg.DB.GetChirps()
+  } else {
+    dbChirps, err = cfg.DB.GetChirpsByAuthor(authorId)
+  }
   if err != nil {
     respondWithError(w, http.StatusInternalServerError, "Could not retrieve chirps")
     return
   }
 
-  chirps := []Chirp{}
+  chirps, err := paginateChirps(w, r, append([]Chirp{}, dbChirps...), sortOrder)
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
 
-  if authorId == 0 {
-    for _, dbChirp := range dbChirps {
-      chirps = append(chirps, Chirp{
-        ID:   dbChirp.ID,
-        Body: dbChirp.Body,
-        Author_ID: dbChirp.Author_ID,
-      })
-    }
-  } else {
-    for _, dbChirp := range dbChirps {
-      if dbChirp.Author_ID == authorId {
-        chirps = append(chirps, Chirp{
-          ID:   dbChirp.ID,
-          Body: dbChirp.Body,
-          Author_ID: dbChirp.Author_ID,
-        })
-      }
-    }
+  respondWithJSON(w, http.StatusOK, chirps)
+}
+
+// handlerChirpsSearch serves GET /api/chirps/search?q=; words, `prefix*` and
+// "quoted phrases" can be mixed and all have to match
+func (cfg *apiConfig) handlerChirpsSearch(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query().Get("q")
+  if strings.TrimSpace(q) == "" {
+    respondWithError(w, http.StatusBadRequest, "Missing search query")
+    return
   }
 
-  if sortOrder == "asc" {
-    sort.Slice(chirps, func(i, j int) bool {
-      return chirps[i].ID < chirps[j].ID
-    })
+  limit := defaultPageLimit
+  if limitString := r.URL.Query().Get("limit"); limitString != "" {
+    l, err := strconv.Atoi(limitString)
+    if err != nil || l < 1 {
+      respondWithError(w, http.StatusBadRequest, "limit must be a positive number")
+      return
+    }
+    limit = min(l, maxPageLimit)
   }
-  if sortOrder == "desc" {
-    sort.Slice(chirps, func(i, j int) bool {
-      return chirps[i].ID > chirps[j].ID
-    })
+
+  hits, err := cfg.DB.SearchChirps(q, limit)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not search chirps")
+    return
   }
 
-  respondWithJSON(w, http.StatusOK, chirps)
+  respondWithJSON(w, http.StatusOK, hits)
 }
 
 func (cfg *apiConfig) retrieveChirpById (w http.ResponseWriter, r *http.Request) (Chirp, error) {
@@ -162,42 +238,26 @@ func (cfg *apiConfig) retrieveChirpById (w http.ResponseWriter, r *http.Request)
     return Chirp{}, errors.New("couldn't retrieve id from the GET request")
   }
 
-  dbChirps, err := cfg.DB.GetChirps()
+  dbChirp, err := cfg.DB.GetChirp(id)
   if err != nil {
-    return Chirp{}, errors.New("couldn't retrieve chirp")
+    return Chirp{}, err
   }
 
-  // equivalent to saying the id exceeds available chirps
-  // log.Println(dbChirps)
-  if len(dbChirps) < id {
-    return Chirp{}, errors.New("chirp not found")
-  }
-
-  chirp := Chirp{
-    ID: dbChirps[id-1].ID,
-    Body: dbChirps[id-1].Body,
-    Author_ID: dbChirps[id-1].Author_ID,
-  }
-  return chirp, nil
+  return dbChirp, nil
 }
 
 func (cfg *apiConfig) handlerChirpsRetrieveById(w http.ResponseWriter, r *http.Request) {
   chirp, err := cfg.retrieveChirpById(w, r)
   if err != nil {
-    respondWithError(w, http.StatusForbidden, err.Error())
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
   }
   respondWithJSON(w, http.StatusOK, chirp)
 }
 func (cfg *apiConfig) handlerChirpsDeleteById(w http.ResponseWriter, r *http.Request) {
-  token, errToken := cfg.validateToken(r, "chirpy-access")
-  if errToken != nil {
-    respondWithError(w, http.StatusForbidden, errToken.Error())
-    return
-  }
-
-  user, errU := cfg.DB.FindUserByAccessToken(token)
+  user, errU := cfg.authenticatedUser(r)
   if errU != nil {
-    respondWithError(w, http.StatusForbidden, "Cannot find user with this token")
+    respondWithError(w, http.StatusForbidden, errU.Error())
     return
   }
 
@@ -212,11 +272,12 @@ func (cfg *apiConfig) handlerChirpsDeleteById(w http.ResponseWriter, r *http.Req
     return
   }
 
-  errD := cfg.DB.DeleteChrip(chirp)
+  // deleting only moves the chirp to the trash, see POST /api/chirps/{id}/restore
+  trashed, errD := cfg.DB.TrashChirp(chirp.ID, user)
   if errD != nil {
     respondWithError(w, http.StatusInternalServerError, errD.Error())
     return
   }
 
-  respondWithJSON(w, http.StatusOK, chirp)
+  respondWithJSON(w, http.StatusOK, trashed)
 }
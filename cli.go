@@ -0,0 +1,230 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "os"
+)
+
+// openConfiguredDB opens the database at path with the encryption keys from the environment
+func openConfiguredDB(path string) (*DB, error) {
+  keys, err := loadEncryptionKeys()
+  if err != nil {
+    return nil, err
+  }
+  return NewDB(path, keys...)
+}
+
+// runCommand handles `chirpy <command> ...`; the server only starts
+// when no command was given on the command line
+func runCommand(path string, args []string) error {
+  switch args[0] {
+  case "migrate":
+    return runMigrate(path, args[1:])
+  case "import":
+    return runImport(path, args[1:])
+  case "backup":
+    return runBackup(path, args[1:])
+  case "restore":
+    return runRestore(path, args[1:])
+  case "rotate-key":
+    return runRotateKey(path, args[1:])
+  case "promote":
+    return runPromote(path, args[1:])
+  }
+  return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runMigrate(path string, args []string) error {
+  if !isSQLitePath(path) {
+    return fmt.Errorf("%s is not a sqlite database; migrations only apply to the sql storage", path)
+  }
+  if len(args) != 1 {
+    return errors.New("usage: chirpy migrate up|down|status")
+  }
+
+  conn, err := openSQLConn(path)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  switch args[0] {
+  case "up":
+    applied, err := migrateUp(conn)
+    for _, m := range applied {
+      fmt.Printf("applied %d %s\n", m.version, m.name)
+    }
+    if err == nil && len(applied) == 0 {
+      fmt.Println("already up to date")
+    }
+    return err
+  case "down":
+    m, err := migrateDown(conn)
+    if err != nil {
+      return err
+    }
+    fmt.Printf("reverted %d %s\n", m.version, m.name)
+    return nil
+  case "status":
+    statuses, err := getMigrationStatus(conn)
+    if err != nil {
+      return err
+    }
+    for _, s := range statuses {
+      if s.applied {
+        fmt.Printf("%4d  %-20s applied %s\n", s.version, s.name, s.appliedAt.Format("2006-01-02 15:04:05"))
+      } else {
+        fmt.Printf("%4d  %-20s pending\n", s.version, s.name)
+      }
+    }
+    return nil
+  }
+  return errors.New("usage: chirpy migrate up|down|status")
+}
+
+// runImport copies an existing json database into an empty sqlite one
+func runImport(path string, args []string) error {
+  if len(args) != 1 {
+    return errors.New("usage: chirpy import <database.json>")
+  }
+  if !isSQLitePath(path) {
+    return fmt.Errorf("%s is not a sqlite database; set DB_PATH to the file to import into", path)
+  }
+
+  keys, err := loadEncryptionKeys()
+  if err != nil {
+    return err
+  }
+  source, err := openJSONFileStorage(args[0], keys...)
+  if err != nil {
+    return err
+  }
+  dbStructure, err := source.load()
+  if err != nil {
+    return err
+  }
+
+  target, err := openSQLStorage(path)
+  if err != nil {
+    return err
+  }
+  defer target.Close()
+
+  empty, err := target.isEmpty()
+  if err != nil {
+    return err
+  }
+  if !empty {
+    return fmt.Errorf("%s already has data; refusing to import over it", path)
+  }
+
+  err = target.replace(dbStructure)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("imported %d users and %d chirps into %s\n", len(dbStructure.Users), len(dbStructure.Chirps), path)
+  return nil
+}
+
+// runBackup writes an archive of the database to a file. against a running
+// server use GET /admin/backup instead, which copies the live state
+func runBackup(path string, args []string) error {
+  if len(args) != 1 {
+    return errors.New("usage: chirpy backup <archive.json>")
+  }
+  db, err := openConfiguredDB(path)
+  if err != nil {
+    return err
+  }
+
+  buf := bytes.Buffer{}
+  err = db.Backup(&buf)
+  if err != nil {
+    return err
+  }
+  err = writeFileAtomic(args[0], buf.Bytes())
+  if err != nil {
+    return err
+  }
+  fmt.Printf("backed up %s to %s\n", path, args[0])
+  return nil
+}
+
+// runRestore replaces the database with an archive; stop the server first,
+// it would keep serving (and writing) its cached copy otherwise
+func runRestore(path string, args []string) error {
+  if len(args) != 1 {
+    return errors.New("usage: chirpy restore <archive.json>")
+  }
+  f, err := os.Open(args[0])
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  db, err := openConfiguredDB(path)
+  if err != nil {
+    return err
+  }
+  err = db.Restore(f)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("restored %s from %s\n", path, args[0])
+  return nil
+}
+
+// runRotateKey re-encrypts the json store under DB_ENCRYPTION_NEW_KEY.
+// with the server running use POST /admin/rotate-key instead
+func runRotateKey(path string, args []string) error {
+  if len(args) != 0 {
+    return errors.New("usage: chirpy rotate-key")
+  }
+  newKey, err := parseEncryptionKey(os.Getenv("DB_ENCRYPTION_NEW_KEY"))
+  if err != nil {
+    return fmt.Errorf("DB_ENCRYPTION_NEW_KEY: %w", err)
+  }
+
+  db, err := openConfiguredDB(path)
+  if err != nil {
+    return err
+  }
+  err = db.RotateEncryptionKey(newKey)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("%s is now encrypted with key %s; move DB_ENCRYPTION_NEW_KEY to DB_ENCRYPTION_KEY\n", path, keyID(newKey))
+  return nil
+}
+
+// runPromote gives a user a role, admin unless told otherwise; that is how
+// the first admin comes about. stop the server first, like for restore
+func runPromote(path string, args []string) error {
+  if len(args) < 1 || len(args) > 2 {
+    return errors.New("usage: chirpy promote <email> [user|moderator|admin]")
+  }
+  role := roleAdmin
+  if len(args) == 2 {
+    role = args[1]
+  }
+
+  db, err := openConfiguredDB(path)
+  if err != nil {
+    return err
+  }
+  user, err := db.FindUserByEmail(args[0])
+  if err != nil {
+    return err
+  }
+  if user.ID == 0 {
+    return fmt.Errorf("no user with email %s", args[0])
+  }
+  user, err = db.SetUserRole(user.ID, role)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("%s is now %s\n", user.Email, user.Role)
+  return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+)
+
+// the json store is encrypted with envelope encryption: a random data key
+// encrypts the snapshot and every wal line, and the data key itself is stored
+// in the snapshot wrapped by the key from DB_ENCRYPTION_KEY. rotating the key
+// only needs the wrapped data key (and the snapshot) to be rewritten
+const envelopeCipher = "AES-256-GCM"
+
+type encryptedSnapshot struct {
+  Cipher     string `json:"cipher"`
+  KeyID      string `json:"key_id"`
+  DataKeyID  string `json:"data_key_id"`
+  WrappedKey []byte `json:"wrapped_key"`
+  Data       []byte `json:"data"`
+}
+
+// loadEncryptionKeys reads the keys the json store may be encrypted with.
+// DB_ENCRYPTION_KEY is the current key; during a rotation DB_ENCRYPTION_NEW_KEY
+// holds the next one, and either can open the file until the rotation is done
+func loadEncryptionKeys() ([][]byte, error) {
+  keys := [][]byte{}
+  for _, name := range []string{"DB_ENCRYPTION_KEY", "DB_ENCRYPTION_NEW_KEY"} {
+    value := os.Getenv(name)
+    if value == "" {
+      continue
+    }
+    key, err := parseEncryptionKey(value)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %w", name, err)
+    }
+    keys = append(keys, key)
+  }
+  return keys, nil
+}
+
+// keys are 32 random bytes, base64 encoded (openssl rand -base64 32)
+func parseEncryptionKey(value string) ([]byte, error) {
+  key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+  if err != nil {
+    return nil, errors.New("key is not valid base64")
+  }
+  if len(key) != 32 {
+    return nil, errors.New("key must be 32 bytes")
+  }
+  return key, nil
+}
+
+// keyID identifies a key without giving anything about it away
+func keyID(key []byte) string {
+  sum := sha256.Sum256(key)
+  return hex.EncodeToString(sum[:8])
+}
+
+func newDataKey() ([]byte, string, error) {
+  key := make([]byte, 32)
+  _, err := rand.Read(key)
+  if err != nil {
+    return nil, "", err
+  }
+  id := make([]byte, 8)
+  _, err = rand.Read(id)
+  if err != nil {
+    return nil, "", err
+  }
+  return key, hex.EncodeToString(id), nil
+}
+
+// seal encrypts plaintext with key; the random nonce is prepended to the result
+func seal(key, plaintext []byte) ([]byte, error) {
+  gcm, err := newGCM(key)
+  if err != nil {
+    return nil, err
+  }
+  nonce := make([]byte, gcm.NonceSize())
+  _, err = rand.Read(nonce)
+  if err != nil {
+    return nil, err
+  }
+  return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+  gcm, err := newGCM(key)
+  if err != nil {
+    return nil, err
+  }
+  if len(sealed) < gcm.NonceSize() {
+    return nil, errors.New("ciphertext too short")
+  }
+  nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+  return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+// isEncryptedSnapshot tells an encrypted snapshot apart from a plain DBStructure
+func isEncryptedSnapshot(dat []byte) (encryptedSnapshot, bool) {
+  snapshot := encryptedSnapshot{}
+  if json.Unmarshal(dat, &snapshot) != nil || snapshot.Cipher == "" {
+    return snapshot, false
+  }
+  return snapshot, true
+}
+
+// encryptSnapshot seals dat with the data key and wraps the data key with kek
+func encryptSnapshot(kek, dek []byte, dekID string, dat []byte) ([]byte, error) {
+  wrapped, err := seal(kek, dek)
+  if err != nil {
+    return nil, err
+  }
+  sealed, err := seal(dek, dat)
+  if err != nil {
+    return nil, err
+  }
+  return json.Marshal(encryptedSnapshot{
+    Cipher: envelopeCipher,
+    KeyID: keyID(kek),
+    DataKeyID: dekID,
+    WrappedKey: wrapped,
+    Data: sealed,
+  })
+}
+
+// decryptSnapshot finds the key the snapshot was wrapped with among keys and
+// returns the plaintext along with the key encryption and data keys
+func decryptSnapshot(snapshot encryptedSnapshot, keys [][]byte) (dat, kek, dek []byte, err error) {
+  if snapshot.Cipher != envelopeCipher {
+    return nil, nil, nil, fmt.Errorf("unsupported cipher %q", snapshot.Cipher)
+  }
+  for _, key := range keys {
+    if keyID(key) == snapshot.KeyID {
+      kek = key
+    }
+  }
+  if kek == nil {
+    return nil, nil, nil, fmt.Errorf("database is encrypted with key %s; set DB_ENCRYPTION_KEY", snapshot.KeyID)
+  }
+  dek, err = unseal(kek, snapshot.WrappedKey)
+  if err != nil {
+    return nil, nil, nil, errors.New("couldn't unwrap the data key")
+  }
+  dat, err = unseal(dek, snapshot.Data)
+  if err != nil {
+    return nil, nil, nil, errors.New("couldn't decrypt the database")
+  }
+  return dat, kek, dek, nil
+}
+
+// encrypted wal lines look like "<data key id>:<base64 sealed record>"
+func encryptWALLine(dek []byte, dekID string, record []byte) ([]byte, error) {
+  sealed, err := seal(dek, bytes.TrimSuffix(record, []byte("\n")))
+  if err != nil {
+    return nil, err
+  }
+  line := dekID + ":" + base64.StdEncoding.EncodeToString(sealed) + "\n"
+  return []byte(line), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/base64"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func newTestKey(t *testing.T) []byte {
+  t.Helper()
+  key := make([]byte, 32)
+  _, err := rand.Read(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return key
+}
+
+// openEncryptedDB opens path with keys and closes its log when the test ends
+func openEncryptedDB(t *testing.T, path string, keys ...[]byte) (*DB, error) {
+  t.Helper()
+  db, err := NewDB(path, keys...)
+  if err != nil {
+    return nil, err
+  }
+  t.Cleanup(func() { db.storage.(*jsonFileStorage).Close() })
+  return db, nil
+}
+
+// assertEncrypted checks that none of the chirp bodies are readable on disk
+func assertEncrypted(t *testing.T, path string, bodies ...string) {
+  t.Helper()
+  for _, file := range []string{path, path + ".wal"} {
+    dat, err := os.ReadFile(file)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, body := range bodies {
+      if bytes.Contains(dat, []byte(body)) {
+        t.Fatalf("%s has %q in plain text", file, body)
+      }
+    }
+  }
+}
+
+func TestEncryptedDatabaseRoundTrips(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  key := newTestKey(t)
+  db, err := openEncryptedDB(t, path, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "first secret", "second secret")
+  // one write in the snapshot and one in the log
+  db.storage.(*jsonFileStorage).compact()
+  createChirps(t, db, author, "third secret")
+  db.storage.(*jsonFileStorage).Close()
+  assertEncrypted(t, path, "alice@example.com", "secret")
+
+  db, err = openEncryptedDB(t, path, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chirps, _ := db.GetChirps()
+  if len(chirps) != 3 {
+    t.Fatalf("chirps after reopening = %v", chirpIDs(chirps))
+  }
+  db.storage.(*jsonFileStorage).Close()
+
+  if _, err := openEncryptedDB(t, path); err == nil {
+    t.Fatal("opened an encrypted database without a key")
+  }
+  if _, err := openEncryptedDB(t, path, newTestKey(t)); err == nil {
+    t.Fatal("opened an encrypted database with the wrong key")
+  }
+}
+
+func TestRotationReencryptsUnderTheNewKey(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  oldKey, newKey := newTestKey(t), newTestKey(t)
+  db, err := openEncryptedDB(t, path, oldKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "before the rotation")
+  before, _ := os.ReadFile(path)
+
+  err = db.RotateEncryptionKey(newKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  after, _ := os.ReadFile(path)
+  snapshot, ok := isEncryptedSnapshot(after)
+  if !ok || snapshot.KeyID != keyID(newKey) {
+    t.Fatalf("snapshot after rotating is wrapped with %q, want %q", snapshot.KeyID, keyID(newKey))
+  }
+  if old, _ := isEncryptedSnapshot(before); old.DataKeyID == snapshot.DataKeyID {
+    t.Fatal("rotating kept the old data key")
+  }
+  // the running database writes under the new key straight away
+  createChirps(t, db, author, "after the rotation")
+  db.storage.(*jsonFileStorage).Close()
+  assertEncrypted(t, path, "rotation")
+
+  db, err = openEncryptedDB(t, path, newKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chirps, _ := db.GetChirps()
+  if len(chirps) != 2 {
+    t.Fatalf("chirps after reopening with the new key = %v", chirpIDs(chirps))
+  }
+  db.storage.(*jsonFileStorage).Close()
+
+  if _, err := openEncryptedDB(t, path, oldKey); err == nil {
+    t.Fatal("the old key still opens the database after rotating")
+  }
+}
+
+// while DB_ENCRYPTION_NEW_KEY is set both keys are configured, and the old
+// one keeps reading the database until the rotation has happened
+func TestOldKeyReadsUntilTheRotation(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  oldKey, newKey := newTestKey(t), newTestKey(t)
+  db, err := openEncryptedDB(t, path, oldKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one")
+  db.storage.(*jsonFileStorage).Close()
+
+  t.Setenv("DB_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(oldKey))
+  t.Setenv("DB_ENCRYPTION_NEW_KEY", base64.StdEncoding.EncodeToString(newKey))
+  keys, err := loadEncryptionKeys()
+  if err != nil {
+    t.Fatal(err)
+  }
+  db, err = openEncryptedDB(t, path, keys...)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chirps, _ := db.GetChirps()
+  if len(chirps) != 1 {
+    t.Fatalf("chirps with both keys configured = %v", chirpIDs(chirps))
+  }
+  // nothing was rotated just by configuring the new key
+  createChirps(t, db, author, "two")
+  db.storage.(*jsonFileStorage).Close()
+
+  db, err = openEncryptedDB(t, path, oldKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chirps, _ = db.GetChirps()
+  if len(chirps) != 2 {
+    t.Fatalf("chirps with only the old key = %v", chirpIDs(chirps))
+  }
+}
@@ -5,17 +5,34 @@ import (
   "errors"
   "sync"
   "time"
-  "encoding/json"
 ) 
 
+// DB is what the handlers work with, on top of whichever storage it was
+// opened with; the storage is the part that swaps, see storage
 type DB struct {
-  path string
+  storage storage
   mu  *sync.RWMutex
+  // everything in storage, decoded once at open and kept current by Update
+  data DBStructure
+  idx  *indexes
 }
 
 type DBStructure struct {
   Chirps map[int]Chirp `json:"chirps"`
   Users map[int]User `json:"users"`
+  Notifications map[int]Notification `json:"notifications"`
+  // keyed by kind:chirp:user, see reactionKey
+  Reactions map[string]Reaction `json:"reactions"`
+  // keyed by follower:followee, see followKey
+  Follows map[string]Follow `json:"follows"`
+  Revisions map[int]Revision `json:"revisions"`
+  // keyed by chirp id
+  ChirpFlags map[int]ChirpFlags `json:"chirp_flags"`
+  Reports map[int]Report `json:"reports"`
+  ModerationActions map[int]ModerationAction `json:"moderation_actions"`
+  SubscriptionEvents map[int]SubscriptionEvent `json:"subscription_events"`
+  // last id handed out per table, see nextID
+  Sequences map[string]int `json:"sequences"`
 }
 
 type User struct {
@@ -26,91 +43,216 @@ type User struct {
   RefreshToken string `json:"refresh_token"`
   RefreshTokenRevokedAt string `json:"refresh_token_revoked_at"`
   AccessTokenRevokedAt string `json:"access_token_revoked_at"`
-  IsChirpyRed bool `json:"is_chirpy_red"`
+  // only on users from before subscriptions; backfill turns it into one
+  IsChirpyRed bool `json:"is_chirpy_red,omitempty"`
+  Subscription Subscription `json:"subscription"`
+  CreatedAt time.Time `json:"created_at"`
+  UpdatedAt time.Time `json:"updated_at"`
+  // optional, unique regardless of case; lets others @mention the user
+  Handle string `json:"handle,omitempty"`
+  // suspended users can't log in or use their tokens until SuspendedUntil,
+  // or ever when that is nil; see User.suspended
+  SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+  SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+  SuspensionReason string `json:"suspension_reason,omitempty"`
+  // their chirps are left out of GET /api/chirps while it lasts
+  SuspensionHidesChirps bool `json:"suspension_hides_chirps,omitempty"`
+  // user, moderator or admin; see roleRanks
+  Role string `json:"role"`
 }
 
 type Chirp struct {
   Body string `json:"body"`
   ID int `json:"id"`
   Author_ID int `json:"author_id"`
+  CreatedAt time.Time `json:"created_at"`
+  UpdatedAt time.Time `json:"updated_at"`
+  // hashtags in the body, case-folded and without the #
+  Tags []string `json:"tags"`
+  Mentions []Mention `json:"mentions"`
+  InReplyTo int `json:"in_reply_to,omitempty"`
+  ReplyCount int `json:"reply_count"`
+  LikeCount int `json:"like_count"`
+  RechirpCount int `json:"rechirp_count"`
+  // null until the first edit, see GET /api/chirps/{id}/revisions
+  EditedAt *time.Time `json:"edited_at"`
+  // a deleted chirp that still has replies, kept so its thread holds together
+  Deleted bool `json:"deleted,omitempty"`
+  // set while the chirp is in the trash of its author
+  DeletedAt *time.Time `json:"deleted_at,omitempty"`
+  // published, draft or scheduled (for publish_at)
+  Status string `json:"status"`
+  PublishAt *time.Time `json:"publish_at,omitempty"`
+  // why moderation wants a human to look at this chirp; stored in
+  // chirp_flags, so it never goes out with the chirp, see ChirpFlags
+  ModerationFlags []string `json:"-"`
+  // set when a moderator took the chirp down
+  HiddenAt *time.Time `json:"hidden_at,omitempty"`
 }
 
-// NewDB creates a new database connection
-func NewDB(path string) (*DB, error) {
+// timestamps are always stored and sent in UTC
+func now() time.Time {
+  return time.Now().UTC()
+}
+
+// NewDB creates a new database connection;
+// sqlite files (.db, .sqlite, .sqlite3) get the sql storage, anything else is a json file.
+// with encryption keys the json file is encrypted at rest, see crypt.go
+func NewDB(path string, encryptionKeys ...[]byte) (*DB, error) {
+  if isSQLitePath(path) {
+    if len(encryptionKeys) > 0 {
+      return nil, errors.New("encryption at rest is only supported by the json file storage")
+    }
+    s, err := openSQLStorage(path)
+    if err != nil {
+      return nil, err
+    }
+    return openDB(s)
+  }
+  s, err := openJSONFileStorage(path, encryptionKeys...)
+  if err != nil {
+    return nil, err
+  }
+  return openDB(s)
+}
+
+// NewMemoryDB creates a database that never touches disk; handy for tests
+func NewMemoryDB() (*DB, error) {
+  return openDB(&memoryStorage{})
+}
+
+func openDB(s storage) (*DB, error) {
   db := &DB{
-    path: path,
+    storage: s,
     mu:   &sync.RWMutex{},
   }
   err := db.ensureDB()
   return db, err
 }
 
-// if the database file does not exist, create it 
+// loads the database into memory; if it does not exist yet, create it 
 func (db *DB) ensureDB() error {
-  _, err := os.ReadFile(db.path)
+  dbStructure, err := db.storage.load()
   if errors.Is(err, os.ErrNotExist) {
-    return db.createStructureDB()
+    dbStructure = newDBStructure()
+    err = db.storage.replace(dbStructure)
   }
-  return err
-}
-
-// this creates the structure of the database to write to file 
-func (db *DB) createStructureDB() error {
-  dbStructure := DBStructure{
-    Chirps: map[int]Chirp{},
-    Users: map[int]User{},
-  }
-  return db.writeDB(dbStructure)
-}
-
-func (db *DB) writeDB(dbStructure DBStructure) error {
-  db.mu.Lock()
-  defer db.mu.Unlock()
-
-  dat, err := json.Marshal(dbStructure)
   if err != nil {
     return err
   }
 
-  err = os.WriteFile(db.path, dat, 0600)
-  if err != nil {
-    return err
-  }
-  return nil
+  db.data = dbStructure
+  db.data.attachChirpFlags()
+  db.idx = buildIndexes(&db.data)
+  return db.Update(backfill)
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-  db.mu.RLock()
-  defer db.mu.RUnlock()
-
-  dbStructure := DBStructure{}
-  dat, err := os.ReadFile(db.path)
-  if errors.Is(err, os.ErrNotExist) {
-    return dbStructure, err
+// backfill fills in fields that records from older versions don't have yet.
+// records from before created_at existed get the time they were first loaded,
+// the real creation time is unknown
+func backfill(tx *Tx) error {
+  t := now()
+  for _, chirp := range tx.Chirps() {
+    changed := false
+    if chirp.CreatedAt.IsZero() {
+      chirp.CreatedAt, chirp.UpdatedAt = t, t
+      changed = true
+    }
+    if chirp.Tags == nil {
+      chirp.Tags = extractHashtags(chirp.Body)
+      changed = true
+    }
+    // old chirps were written before anyone could be mentioned
+    if chirp.Mentions == nil {
+      chirp.Mentions = []Mention{}
+      changed = true
+    }
+    if chirp.Status == "" {
+      chirp.Status = chirpPublished
+      changed = true
+    }
+    if changed {
+      err := tx.PutChirp(chirp)
+      if err != nil {
+        return err
+      }
+    }
   }
-  err = json.Unmarshal(dat, &dbStructure)
-  if err != nil {
-    return dbStructure, err
+  for _, user := range tx.Users() {
+    changed := false
+    if user.CreatedAt.IsZero() {
+      user.CreatedAt, user.UpdatedAt = t, t
+      changed = true
+    }
+    if user.Role == "" {
+      user.Role = roleUser
+      changed = true
+    }
+    // Chirpy Red used to be for good, so it stays that way
+    if user.Subscription.Plan == "" {
+      user.Subscription.Plan = planFree
+      if user.IsChirpyRed {
+        started := user.UpdatedAt
+        user.Subscription = Subscription{Plan: planRed, Status: subscriptionActive, StartedAt: &started}
+        user.IsChirpyRed = false
+      }
+      changed = true
+    }
+    if changed {
+      err := tx.PutUser(user)
+      if err != nil {
+        return err
+      }
+    }
   }
-
-  return dbStructure, nil
+  return nil
 }
 
-func (db *DB) CreateChirp(body string, user User) (Chirp, error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return Chirp{}, err
-  }
+// RotateEncryptionKey re-encrypts the database under newKey while holding
+// the write lock, so requests only wait for the snapshot to be rewritten
+func (db *DB) RotateEncryptionKey(newKey []byte) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
 
-  id := len(dbStructure.Chirps) + 1
-  chirp := Chirp{
-    ID:   id,
-    Body: body,
-    Author_ID: user.ID,
+  rotator, ok := db.storage.(keyRotator)
+  if !ok {
+    return errors.New("this storage does not support encryption at rest")
   }
-  dbStructure.Chirps[id] = chirp
+  return rotator.rotateKey(newKey)
+}
+
+// CreateChirp stores chirp as a new chirp by user; the handler fills in the
+// content (body, tags, status, ...) and the id, author and timestamps are set
+// here. drafts and scheduled chirps are only stored, see publishChirp
+func (db *DB) CreateChirp(chirp Chirp, user User) (Chirp, error) {
+  err := db.Update(func(tx *Tx) error {
+    id, err := tx.NextID("chirps")
+    if err != nil {
+      return err
+    }
+    t := now()
+    chirp.ID = id
+    chirp.Author_ID = user.ID
+    chirp.CreatedAt = t
+    chirp.UpdatedAt = t
+    chirp.Mentions = []Mention{}
+    chirp.ReplyCount, chirp.LikeCount, chirp.RechirpCount = 0, 0, 0
+    chirp.EditedAt = nil
+    chirp.DeletedAt = nil
+    chirp.HiddenAt = nil
+    if !chirp.unpublished() {
+      chirp, err = tx.publishChirp(chirp)
+      return err
+    }
 
-  err = db.writeDB(dbStructure)
+    if chirp.InReplyTo != 0 {
+      parent, ok := tx.Chirp(chirp.InReplyTo)
+      if !ok || parent.hidden() {
+        return errParentNotFound
+      }
+    }
+    return tx.PutChirp(chirp)
+  })
   if err != nil {
     return Chirp{}, err
   }
@@ -119,53 +261,86 @@ func (db *DB) CreateChirp(body string, user User) (Chirp, error) {
 }
 
 func (db *DB) GetChirps() ([]Chirp, error) {
-  dbStructure, err := db.loadDB()
+  chirps := []Chirp{}
+  err := db.View(func(tx *Tx) error {
+    chirps = tx.withoutSuspendedAuthors(tx.Chirps())
+    return nil
+  })
   if err != nil {
     return nil, err
   }
 
-  chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-  for _, chirp := range dbStructure.Chirps {
-    chirps = append(chirps, chirp)
-  }
-
   return chirps, nil
 }
 
-func (db *DB) DeleteChrip (chirp Chirp) (error) {
-  dbStructure, err := db.loadDB()
+func (db *DB) GetChirp(id int) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.View(func(tx *Tx) error {
+    var ok bool
+    chirp, ok = tx.Chirp(id)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    return nil
+  })
+  return chirp, err
+}
+
+func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+  chirps := []Chirp{}
+  err := db.View(func(tx *Tx) error {
+    chirps = tx.withoutSuspendedAuthors(tx.ChirpsByAuthor(authorId))
+    return nil
+  })
   if err != nil {
-    return err
+    return nil, err
   }
 
-  // we are deleting the key of ID from the map
-  delete(dbStructure.Chirps, chirp.ID)
+  return chirps, nil
+}
 
-  errW := db.writeDB(dbStructure)
-  if errW != nil {
-    return errW
-  }
+func (db *DB) SearchChirps(q string, limit int) ([]searchHit, error) {
+  hits := []searchHit{}
+  err := db.View(func(tx *Tx) error {
+    hits = tx.SearchChirps(q, limit)
+    return nil
+  })
+  return hits, err
+}
 
-  return nil
+// DeleteChrip deletes a chirp for good, without going through the trash
+func (db *DB) DeleteChrip (chirp Chirp) (error) {
+  return db.Update(func(tx *Tx) error {
+    // re-read it, a reply may have come in since the handler looked
+    chirp, ok := tx.Chirp(chirp.ID)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    return tx.removeChirp(chirp)
+  })
 }
 
 func (db *DB) CreateUser(email string, password string) (User, error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return User{}, err
-  }
-
-  id := len(dbStructure.Users) + 1
   hash, _ := HashPassword(password)
 
-  user := User{
-    ID:   id,
-    Email: email,
-    Hash: hash,
-  }
-  dbStructure.Users[id] = user
-
-  err = db.writeDB(dbStructure)
+  user := User{}
+  err := db.Update(func(tx *Tx) error {
+    id, err := tx.NextID("users")
+    if err != nil {
+      return err
+    }
+    t := now()
+    user = User{
+      ID:   id,
+      Email: email,
+      Hash: hash,
+      Role: roleUser,
+      Subscription: Subscription{Plan: planFree},
+      CreatedAt: t,
+      UpdatedAt: t,
+    }
+    return tx.PutUser(user)
+  })
   if err != nil {
     return User{}, err
   }
@@ -173,22 +348,21 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
   return user, nil
 }
 
-func (db *DB) UpdateUser(userId int, email, hashedPassword string) (User, error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return User{}, err
-  }
-
-  user, ok := dbStructure.Users[userId]
-  if !ok {
-    return User{}, errors.New("already exists")
-  }
-
-  user.Email = email
-  user.Hash = hashedPassword
-  dbStructure.Users[userId] = user
-
-  err = db.writeDB(dbStructure)
+// updateUser loads the user, lets change modify it and writes it back, all in one transaction
+func (db *DB) updateUser(userId int, change func(user *User) error) (User, error) {
+  user := User{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    user, ok = tx.User(userId)
+    if !ok {
+      return errors.New("user not found")
+    }
+    err := change(&user)
+    if err != nil {
+      return err
+    }
+    return tx.PutUser(user)
+  })
   if err != nil {
     return User{}, err
   }
@@ -196,94 +370,66 @@ func (db *DB) UpdateUser(userId int, email, hashedPassword string) (User, error)
   return user, nil
 }
 
-func (db *DB) UpgradeUserToRed(userId int) (error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return err
-  }
-
-  user, ok := dbStructure.Users[userId]
-  if !ok {
-    return errors.New("already exists")
-  }
-
-  user.IsChirpyRed = true
-  dbStructure.Users[userId] = user
-
-  err = db.writeDB(dbStructure)
-  if err != nil {
-    return err
-  }
-
-  return nil
+func (db *DB) UpdateUser(userId int, email, hashedPassword string) (User, error) {
+  return db.updateUser(userId, func(user *User) error {
+    user.Email = email
+    user.Hash = hashedPassword
+    user.UpdatedAt = now()
+    return nil
+  })
 }
 
-func (db *DB) SetUserTokens(userId int, accessToken, refreshToken string) (User, error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return User{}, err
-  }
-
-  user, ok := dbStructure.Users[userId]
-  if !ok {
-    return User{}, errors.New("already exists")
-  }
 
-  user.AccessToken = accessToken
-  user.RefreshToken = refreshToken
-  dbStructure.Users[userId] = user
-
-  err = db.writeDB(dbStructure)
-  if err != nil {
-    return User{}, err
-  }
+func (db *DB) SetUserTokens(userId int, accessToken, refreshToken string) (User, error) {
+  return db.updateUser(userId, func(user *User) error {
+    // a new refresh token starts out unrevoked
+    if user.RefreshToken != refreshToken {
+      user.RefreshTokenRevokedAt = ""
+    }
+    user.AccessToken = accessToken
+    user.RefreshToken = refreshToken
+    return nil
+  })
+}
 
-  return user, nil
+// the FindUserBy lookups return an empty User when nothing matches
+func (db *DB) FindUserByEmail(email string) (User, error) {
+  user := User{}
+  err := db.View(func(tx *Tx) error {
+    user, _ = tx.UserByEmail(email)
+    return nil
+  })
+  return user, err
 }
 
 func (db *DB) FindUserByRefreshToken (refreshToken string) (User, error) {
-  dbUsers, err := db.GetUsers()
-  if err != nil {
-    return User{}, err
-  }
-  
-  for _, dbUser := range dbUsers {
-    if dbUser.RefreshToken == refreshToken {
-      return dbUser, nil
-    }
-  }
-
-  return User{}, nil
+  user := User{}
+  err := db.View(func(tx *Tx) error {
+    user, _ = tx.UserByRefreshToken(refreshToken)
+    return nil
+  })
+  return user, err
 }
 func (db *DB) FindUserByAccessToken (accessToken string) (User, error) {
-  dbUsers, err := db.GetUsers()
-  if err != nil {
-    return User{}, err
-  }
-  
-  for _, dbUser := range dbUsers {
-    if dbUser.AccessToken == accessToken {
-      return dbUser, nil
-    }
-  }
-
-  return User{}, nil
+  user := User{}
+  err := db.View(func(tx *Tx) error {
+    user, _ = tx.UserByAccessToken(accessToken)
+    return nil
+  })
+  return user, err
 }
 func (db *DB) RevokeRefreshToken(refreshToken string) (User, error) {
-  dbStructure, err := db.loadDB()
-  if err != nil {
-    return User{}, err
-  }
-
-  user, err := db.FindUserByRefreshToken(refreshToken)
-  if err != nil {
-    return User{}, err
-  }
-
-  user.RefreshTokenRevokedAt = time.Now().String()
-  dbStructure.Users[user.ID] = user
+  user := User{}
+  err := db.Update(func(tx *Tx) error {
+    var found bool
+    user, found = tx.UserByRefreshToken(refreshToken)
+    if !found {
+      return errors.New("refresh token not found")
+    }
 
-  err = db.writeDB(dbStructure)
+    user.RefreshTokenRevokedAt = time.Now().String()
+    return tx.PutUser(user)
+  })
   if err != nil {
     return User{}, err
   }
@@ -291,15 +437,27 @@ func (db *DB) RevokeRefreshToken(refreshToken string) (User, error) {
   return user, nil
 }
 func (db *DB) GetUsers() ([]User, error) {
-  dbStructure, err := db.loadDB()
+  users := []User{}
+  err := db.View(func(tx *Tx) error {
+    users = tx.Users()
+    return nil
+  })
   if err != nil {
     return nil, err
   }
 
-  users := make([]User, 0, len(dbStructure.Users))
-  for _, user := range dbStructure.Users {
-    users = append(users, user)
-  }
-
   return users, nil
 }
+
+func (db *DB) GetUser(id int) (User, error) {
+  user := User{}
+  err := db.View(func(tx *Tx) error {
+    var ok bool
+    user, ok = tx.User(id)
+    if !ok {
+      return errors.New("user not found")
+    }
+    return nil
+  })
+  return user, err
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func createChirps(t *testing.T, db *DB, author User, bodies ...string) []Chirp {
+  t.Helper()
+  chirps := []Chirp{}
+  for _, body := range bodies {
+    chirp, err := db.CreateChirp(Chirp{Body: body}, author)
+    if err != nil {
+      t.Fatal(err)
+    }
+    chirps = append(chirps, chirp)
+  }
+  return chirps
+}
+
+func chirpIDs(chirps []Chirp) []int {
+  ids := []int{}
+  for _, chirp := range chirps {
+    ids = append(ids, chirp.ID)
+  }
+  return ids
+}
+
+func TestIDsAreNotReusedAfterDeletes(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, err := db.CreateUser("alice@example.com", "hunter2")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  chirps := createChirps(t, db, author, "one", "two", "three")
+  if ids := chirpIDs(chirps); ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+    t.Fatalf("ids = %v", ids)
+  }
+
+  // deleting from the middle used to make the next chirp overwrite the last one
+  err = db.DeleteChrip(chirps[1])
+  if err != nil {
+    t.Fatal(err)
+  }
+  four := createChirps(t, db, author, "four")[0]
+  if four.ID != 4 {
+    t.Fatalf("chirp after a delete got id %d", four.ID)
+  }
+  three, err := db.GetChirp(3)
+  if err != nil || three.Body != "three" {
+    t.Fatalf("GetChirp(3) = %+v, %v", three, err)
+  }
+  if _, err := db.GetChirp(2); err == nil {
+    t.Fatal("GetChirp(2) found the deleted chirp")
+  }
+
+  // neither is the highest id handed out again once it is gone
+  err = db.DeleteChrip(four)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if five := createChirps(t, db, author, "five")[0]; five.ID != 5 {
+    t.Fatalf("chirp after deleting the newest one got id %d", five.ID)
+  }
+}
+
+func TestLookupsByKey(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  chirps := createChirps(t, db, bob, "one", "two", "three")
+
+  // with the first chirp gone, position and id no longer line up
+  err = db.DeleteChrip(chirps[0])
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, want := range chirps[1:] {
+    got, err := db.GetChirp(want.ID)
+    if err != nil || got.Body != want.Body {
+      t.Fatalf("GetChirp(%d) = %+v, %v", want.ID, got, err)
+    }
+  }
+
+  for _, want := range []User{alice, bob} {
+    got, err := db.GetUser(want.ID)
+    if err != nil || got.Email != want.Email {
+      t.Fatalf("GetUser(%d) = %+v, %v", want.ID, got, err)
+    }
+    got, err = db.FindUserByEmail(want.Email)
+    if err != nil || got.ID != want.ID {
+      t.Fatalf("FindUserByEmail(%s) = %+v, %v", want.Email, got, err)
+    }
+  }
+  if _, err := db.GetUser(3); err == nil {
+    t.Fatal("GetUser(3) found a user that does not exist")
+  }
+}
+
+func TestSequencesSurviveReopening(t *testing.T) {
+  for _, name := range []string{"database.json", "database.db"} {
+    t.Run(name, func(t *testing.T) {
+      path := filepath.Join(t.TempDir(), name)
+      db, err := NewDB(path)
+      if err != nil {
+        t.Fatal(err)
+      }
+      author, _ := db.CreateUser("alice@example.com", "hunter2")
+      chirps := createChirps(t, db, author, "one", "two", "three")
+      err = db.DeleteChrip(chirps[2])
+      if err != nil {
+        t.Fatal(err)
+      }
+      if closer, ok := db.storage.(io.Closer); ok {
+        closer.Close()
+      }
+
+      db, err = NewDB(path)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if closer, ok := db.storage.(io.Closer); ok {
+        defer closer.Close()
+      }
+      if four := createChirps(t, db, author, "four")[0]; four.ID != 4 {
+        t.Fatalf("first chirp after reopening got id %d", four.ID)
+      }
+    })
+  }
+}
+
+func TestChirpFlagsSurviveReopening(t *testing.T) {
+  for _, name := range []string{"database.json", "database.db"} {
+    t.Run(name, func(t *testing.T) {
+      path := filepath.Join(t.TempDir(), name)
+      db, err := NewDB(path)
+      if err != nil {
+        t.Fatal(err)
+      }
+      author, _ := db.CreateUser("alice@example.com", "hunter2")
+      _, err = db.CreateChirp(Chirp{Body: "a sharbert", ModerationFlags: []string{"flagged word: sharbert"}}, author)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if closer, ok := db.storage.(io.Closer); ok {
+        closer.Close()
+      }
+
+      db, err = NewDB(path)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if closer, ok := db.storage.(io.Closer); ok {
+        defer closer.Close()
+      }
+      chirp, err := db.GetChirp(1)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(chirp.ModerationFlags) != 1 {
+        t.Fatalf("flags after reopening = %v", chirp.ModerationFlags)
+      }
+      if queue, _ := db.GetModerationQueue(); len(queue) != 1 {
+        t.Fatalf("queue after reopening = %+v", queue)
+      }
+    })
+  }
+}
+
+// openJSONDB opens a json file database in a fresh directory and closes its
+// log when the test ends
+func openJSONDB(t *testing.T, path string) *DB {
+  t.Helper()
+  db, err := NewDB(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { db.storage.(*jsonFileStorage).Close() })
+  return db
+}
+
+func fileSize(t *testing.T, path string) int64 {
+  t.Helper()
+  info, err := os.Stat(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return info.Size()
+}
+
+func TestWALIsReplayedAfterReopening(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  db := openJSONDB(t, path)
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one", "two")
+  db.storage.(*jsonFileStorage).Close()
+
+  // nothing was compacted, so the chirps only exist in the log
+  dat, err := os.ReadFile(path)
+  if err != nil && !errors.Is(err, os.ErrNotExist) {
+    t.Fatal(err)
+  }
+  if bytes.Contains(dat, []byte(`"body":"one"`)) {
+    t.Fatal("chirps were written to the snapshot before compaction")
+  }
+  db = openJSONDB(t, path)
+  chirps, err := db.GetChirps()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ids := chirpIDs(chirps); len(ids) != 2 {
+    t.Fatalf("chirps after reopening = %v", ids)
+  }
+}
+
+func TestWALTornTailIsCutOff(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  db := openJSONDB(t, path)
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one")
+  db.storage.(*jsonFileStorage).Close()
+
+  walPath := path + ".wal"
+  before, err := os.ReadFile(walPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  torn := `{"mutations":[{"table":"chirps","key":"99","val`
+  wal, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  wal.WriteString(torn)
+  wal.Close()
+
+  db = openJSONDB(t, path)
+  after, err := os.ReadFile(walPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.HasPrefix(after, before) || bytes.Contains(after, []byte(torn)) {
+    t.Fatalf("torn tail still in the wal after opening:\n%s", after)
+  }
+  createChirps(t, db, author, "two")
+  db.storage.(*jsonFileStorage).Close()
+
+  db = openJSONDB(t, path)
+  chirps, _ := db.GetChirps()
+  if ids := chirpIDs(chirps); len(ids) != 2 {
+    t.Fatalf("chirps after the torn tail = %v", ids)
+  }
+}
+
+func TestWALCorruptLineFailsTheOpen(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  db := openJSONDB(t, path)
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one", "two")
+  db.storage.(*jsonFileStorage).Close()
+
+  walPath := path + ".wal"
+  dat, err := os.ReadFile(walPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  first, rest, _ := bytes.Cut(dat, []byte("\n"))
+  corrupt := append(append(first, []byte("\nnot json\n")...), rest...)
+  err = os.WriteFile(walPath, corrupt, 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // a complete line that does not decode is not a crash mid-write,
+  // so skipping it would silently lose what came after
+  _, err = NewDB(path)
+  if err == nil || !strings.Contains(err.Error(), "line 2 is corrupt") {
+    t.Fatalf("NewDB with a corrupt line = %v", err)
+  }
+  if got, _ := os.ReadFile(walPath); !bytes.Equal(got, corrupt) {
+    t.Fatal("opening changed a corrupt wal")
+  }
+}
+
+func TestWALFailedAppendIsRolledBack(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  db := openJSONDB(t, path)
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one")
+
+  walPath := path + ".wal"
+  size := fileSize(t, walPath)
+  // room for part of the next line, so the write is torn half way
+  lift := limitFileSize(t, size+10)
+  _, err := db.CreateChirp(Chirp{Body: "two"}, author)
+  lift()
+  if err == nil {
+    t.Fatal("CreateChirp succeeded past the file size limit")
+  }
+  if got := fileSize(t, walPath); got != size {
+    t.Fatalf("wal is %d bytes after the failed append, want %d", got, size)
+  }
+  if _, err := db.GetChirp(2); err == nil {
+    t.Fatal("the failed chirp is in the cache")
+  }
+  db.storage.(*jsonFileStorage).Close()
+
+  db = openJSONDB(t, path)
+  chirps, _ := db.GetChirps()
+  if ids := chirpIDs(chirps); len(ids) != 1 {
+    t.Fatalf("chirps after the failed append = %v", ids)
+  }
+}
+
+func TestWALIsCompactedIntoTheSnapshot(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "database.json")
+  db := openJSONDB(t, path)
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "one")
+
+  // the next write is the one that reaches the threshold
+  storage := db.storage.(*jsonFileStorage)
+  storage.walRecords = walCompactEvery - 1
+  createChirps(t, db, author, "two")
+  if got := fileSize(t, path+".wal"); got != 0 {
+    t.Fatalf("wal is %d bytes after compacting", got)
+  }
+  if storage.walRecords != 0 {
+    t.Fatalf("walRecords = %d after compacting", storage.walRecords)
+  }
+  snapshot := DBStructure{}
+  dat, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = json.Unmarshal(dat, &snapshot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(snapshot.Chirps) != 2 || len(snapshot.Users) != 1 {
+    t.Fatalf("snapshot has %d chirps and %d users", len(snapshot.Chirps), len(snapshot.Users))
+  }
+  storage.Close()
+
+  db = openJSONDB(t, path)
+  if three := createChirps(t, db, author, "three")[0]; three.ID != 3 {
+    t.Fatalf("first chirp after compacting got id %d", three.ID)
+  }
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// the states of a chirp; only published ones are visible to anybody but their author
+const (
+  chirpPublished = "published"
+  chirpDraft     = "draft"
+  chirpScheduled = "scheduled"
+)
+
+// how often the scheduler looks for chirps whose publish_at has come
+const schedulerInterval = time.Second
+
+func (c Chirp) unpublished() bool {
+  return c.Status == chirpDraft || c.Status == chirpScheduled
+}
+
+// schedule sets the state a chirp should be in: a draft, scheduled for
+// publishAt, or published right away when publishAt has already passed
+func (c *Chirp) schedule(draft bool, publishAt *time.Time) {
+  c.Status = chirpPublished
+  c.PublishAt = nil
+  switch {
+  case draft:
+    c.Status = chirpDraft
+  case publishAt != nil && publishAt.After(now()):
+    c.Status = chirpScheduled
+    t := publishAt.UTC()
+    c.PublishAt = &t
+  }
+}
+
+// publishChirp makes a chirp visible and does everything that comes with
+// posting it: mentions are resolved and notified and the parent counts the
+// reply. whatever publishes a chirp flips its status in the same
+// transaction, so a chirp is published exactly once
+func (tx *Tx) publishChirp(chirp Chirp) (Chirp, error) {
+  t := now()
+  chirp.Status = chirpPublished
+  chirp.PublishAt = nil
+  chirp.CreatedAt = t
+  chirp.UpdatedAt = t
+  chirp.Mentions = tx.ResolveMentions(chirp.Body)
+  err := tx.PutChirp(chirp)
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  // a user mentioned twice still hears about it once
+  mentioned := map[int]bool{}
+  for _, mention := range chirp.Mentions {
+    if mentioned[mention.UserID] {
+      continue
+    }
+    mentioned[mention.UserID] = true
+    err := tx.notify(mention.UserID, notificationMention, chirp.ID, chirp.Author_ID)
+    if err != nil {
+      return Chirp{}, err
+    }
+  }
+  if chirp.InReplyTo == 0 {
+    return chirp, nil
+  }
+  parent, err := tx.addReply(chirp)
+  if err != nil {
+    return Chirp{}, err
+  }
+  if !mentioned[parent.Author_ID] {
+    err = tx.notify(parent.Author_ID, notificationReply, chirp.ID, chirp.Author_ID)
+  }
+  return chirp, err
+}
+
+// Drafts returns the drafts and scheduled chirps of one author, in no particular order
+func (tx *Tx) Drafts(authorId int) []Chirp {
+  ids := tx.db.idx.draftsByAuthor[authorId]
+  chirps := make([]Chirp, 0, len(ids))
+  for id := range ids {
+    chirps = append(chirps, tx.db.data.Chirps[id])
+  }
+  return chirps
+}
+
+func (db *DB) GetDrafts(authorId int) ([]Chirp, error) {
+  chirps := []Chirp{}
+  err := db.View(func(tx *Tx) error {
+    chirps = tx.Drafts(authorId)
+    return nil
+  })
+  return chirps, err
+}
+
+// draft loads an unpublished chirp of user
+func (tx *Tx) draft(id int, user User) (Chirp, error) {
+  chirp, ok := tx.Chirp(id)
+  if !ok || !chirp.unpublished() {
+    return Chirp{}, errors.New("draft not found")
+  }
+  if chirp.Author_ID != user.ID {
+    return Chirp{}, errNotChirpAuthor
+  }
+  return chirp, nil
+}
+
+// UpdateDraft lets change modify a draft of user and writes it back;
+// if change publishes it, it is published right here
+func (db *DB) UpdateDraft(id int, user User, change func(chirp *Chirp)) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.Update(func(tx *Tx) error {
+    var err error
+    chirp, err = tx.draft(id, user)
+    if err != nil {
+      return err
+    }
+    change(&chirp)
+    if !chirp.unpublished() {
+      chirp, err = tx.publishChirp(chirp)
+      return err
+    }
+    chirp.UpdatedAt = now()
+    return tx.PutChirp(chirp)
+  })
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  return chirp, nil
+}
+
+// DeleteDraft deletes a draft of user for good; nobody else ever saw it
+func (db *DB) DeleteDraft(id int, user User) error {
+  return db.Update(func(tx *Tx) error {
+    _, err := tx.draft(id, user)
+    if err != nil {
+      return err
+    }
+    return tx.DeleteChirp(id)
+  })
+}
+
+// PublishDue publishes every scheduled chirp whose publish_at is not after t,
+// each in its own transaction, and returns how many it published. chirps
+// whose parent went away while they waited are turned back into drafts
+func (db *DB) PublishDue(t time.Time) (int, error) {
+  due := []int{}
+  err := db.View(func(tx *Tx) error {
+    for id := range tx.db.idx.scheduled {
+      if chirp, _ := tx.Chirp(id); !chirp.PublishAt.After(t) {
+        due = append(due, id)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return 0, err
+  }
+
+  published := 0
+  for _, id := range due {
+    didPublish := false
+    err := db.Update(func(tx *Tx) error {
+      chirp, ok := tx.Chirp(id)
+      // published or edited since we looked
+      if !ok || chirp.Status != chirpScheduled || chirp.PublishAt.After(t) {
+        return nil
+      }
+      if chirp.InReplyTo != 0 {
+        parent, ok := tx.Chirp(chirp.InReplyTo)
+        if !ok || parent.hidden() {
+          log.Printf("Chirp %d replies to a chirp that is gone, keeping it as a draft", id)
+          chirp.schedule(true, nil)
+          return tx.PutChirp(chirp)
+        }
+      }
+      _, err := tx.publishChirp(chirp)
+      didPublish = err == nil
+      return err
+    })
+    if err != nil {
+      return published, err
+    }
+    if didPublish {
+      published++
+    }
+  }
+  return published, nil
+}
+
+// runScheduler publishes due chirps every interval, forever. it starts with
+// the ones that came due while the server was down
+func (cfg *apiConfig) runScheduler(interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    _, err := cfg.DB.PublishDue(now())
+    if err != nil {
+      log.Printf("Error publishing scheduled chirps: %s", err)
+    }
+    <-ticker.C
+  }
+}
+
+// handlerDraftsRetrieve serves GET /api/drafts, drafts and scheduled chirps
+// alike, the most recently written first
+func (cfg *apiConfig) handlerDraftsRetrieve(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  drafts, err := cfg.DB.GetDrafts(user.ID)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve drafts")
+    return
+  }
+
+  params, err := parsePageParams(r, "desc")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := chirpSortKey("desc")
+  sortBy(drafts, keyOf, idDescending)
+  page, next := paginate(drafts, params, keyOf, idDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
+
+// handlerDraftsUpdate serves PUT /api/drafts/{id}. fields left out stay as
+// they are; "draft": false without a publish_at publishes right away
+func (cfg *apiConfig) handlerDraftsUpdate(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Body      *string    `json:"body"`
+    Draft     *bool      `json:"draft"`
+    PublishAt *time.Time `json:"publish_at"`
+  }
+
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the PUT request")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+
+  moderation := Moderation{}
+  if params.Body != nil {
+    moderation, err = cfg.validateChirp(*params.Body, user)
+    if err != nil {
+      respondWithError(w, http.StatusBadRequest, err.Error())
+      return
+    }
+  }
+
+  chirp, err := cfg.DB.UpdateDraft(id, user, func(chirp *Chirp) {
+    if params.Body != nil {
+      chirp.Body = moderation.Body
+      chirp.Tags = extractHashtags(moderation.Body)
+      chirp.ModerationFlags = moderation.Flags
+    }
+    if params.Draft != nil || params.PublishAt != nil {
+      chirp.schedule(params.Draft != nil && *params.Draft, params.PublishAt)
+    }
+  })
+  if errors.Is(err, errNotChirpAuthor) {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+  if errors.Is(err, errParentNotFound) {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// handlerDraftsDelete serves DELETE /api/drafts/{id}
+func (cfg *apiConfig) handlerDraftsDelete(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the DELETE request")
+    return
+  }
+
+  err = cfg.DB.DeleteDraft(id, user)
+  if errors.Is(err, errNotChirpAuthor) {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+const notificationFollow = "follow"
+
+type Follow struct {
+  FollowerID int       `json:"follower_id"`
+  FolloweeID int       `json:"followee_id"`
+  CreatedAt  time.Time `json:"created_at"`
+}
+
+// followKey is the key of a follow, so following twice finds the first one
+func followKey(followerId, followeeId int) string {
+  return fmt.Sprintf("%d:%d", followerId, followeeId)
+}
+
+func (f Follow) key() string {
+  return followKey(f.FollowerID, f.FolloweeID)
+}
+
+func (tx *Tx) Follow(followerId, followeeId int) (Follow, bool) {
+  follow, ok := tx.db.data.Follows[followKey(followerId, followeeId)]
+  return follow, ok
+}
+
+// Followers returns who follows userId, in no particular order
+func (tx *Tx) Followers(userId int) []Follow {
+  ids := tx.db.idx.followers[userId]
+  follows := make([]Follow, 0, len(ids))
+  for followerId := range ids {
+    follows = append(follows, tx.db.data.Follows[followKey(followerId, userId)])
+  }
+  return follows
+}
+
+// Following returns who userId follows, in no particular order
+func (tx *Tx) Following(userId int) []Follow {
+  ids := tx.db.idx.following[userId]
+  follows := make([]Follow, 0, len(ids))
+  for followeeId := range ids {
+    follows = append(follows, tx.db.data.Follows[followKey(userId, followeeId)])
+  }
+  return follows
+}
+
+func (tx *Tx) PutFollow(follow Follow) error {
+  return tx.write(putNamedRecord("follows", follow.key(), follow))
+}
+
+func (tx *Tx) DeleteFollow(follow Follow) error {
+  return tx.write(putNamedRecord("follows", follow.key(), nil))
+}
+
+// SetFollow makes follower follow (on == true) or unfollow followeeId;
+// doing either twice changes nothing
+func (db *DB) SetFollow(follower User, followeeId int, on bool) error {
+  if follower.ID == followeeId {
+    return errors.New("you cannot follow yourself")
+  }
+  return db.Update(func(tx *Tx) error {
+    if _, ok := tx.User(followeeId); !ok {
+      return errors.New("user not found")
+    }
+
+    follow, exists := tx.Follow(follower.ID, followeeId)
+    if exists == on {
+      return nil
+    }
+    if !on {
+      return tx.DeleteFollow(follow)
+    }
+
+    err := tx.PutFollow(Follow{FollowerID: follower.ID, FolloweeID: followeeId, CreatedAt: now()})
+    if err != nil {
+      return err
+    }
+    return tx.notify(followeeId, notificationFollow, 0, follower.ID)
+  })
+}
+
+// followedUser is a user as they show up in a list of followers or followings
+type followedUser struct {
+  UserResponse
+  FollowedAt time.Time `json:"followed_at"`
+}
+
+// GetFollows returns the followers (followers == true) or the followings of userId
+func (db *DB) GetFollows(userId int, followers bool) ([]followedUser, error) {
+  users := []followedUser{}
+  err := db.View(func(tx *Tx) error {
+    if _, ok := tx.User(userId); !ok {
+      return errors.New("user not found")
+    }
+
+    follows := tx.Following(userId)
+    if followers {
+      follows = tx.Followers(userId)
+    }
+    for _, follow := range follows {
+      otherId := follow.FolloweeID
+      if followers {
+        otherId = follow.FollowerID
+      }
+      if user, ok := tx.User(otherId); ok {
+        users = append(users, followedUser{UserResponse: newUserResponse(user), FollowedAt: follow.CreatedAt})
+      }
+    }
+    return nil
+  })
+  return users, err
+}
+
+// handlerUsersFollow serves POST (follow) and DELETE (unfollow) on /api/users/{id}/follow
+func (cfg *apiConfig) handlerUsersFollow(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  err = cfg.DB.SetFollow(user, id, r.Method == http.MethodPost)
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUsersFollowers(w http.ResponseWriter, r *http.Request) {
+  cfg.respondWithFollows(w, r, true)
+}
+
+func (cfg *apiConfig) handlerUsersFollowing(w http.ResponseWriter, r *http.Request) {
+  cfg.respondWithFollows(w, r, false)
+}
+
+// respondWithFollows pages through followers or followings, most recent first
+func (cfg *apiConfig) respondWithFollows(w http.ResponseWriter, r *http.Request, followers bool) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the GET request")
+    return
+  }
+
+  users, err := cfg.DB.GetFollows(id, followers)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  params, err := parsePageParams(r, "-followed_at")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(u followedUser) pageCursor {
+    return pageCursor{Sort: "-followed_at", Time: u.FollowedAt, ID: u.ID}
+  }
+  sortBy(users, keyOf, timeDescending)
+  page, next := paginate(users, params, keyOf, timeDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "testing"
+
+func limitFileSize(t *testing.T, size int64) func() {
+  t.Skip("no file size limit on this platform")
+  return nil
+}
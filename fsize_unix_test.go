@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+  "syscall"
+  "testing"
+)
+
+// limitFileSize makes writes past size fail with EFBIG, like a full disk
+// would, until the returned func or the end of the test lifts it.
+// go ignores SIGXFSZ so the write just errors
+func limitFileSize(t *testing.T, size int64) func() {
+  t.Helper()
+  old := syscall.Rlimit{}
+  err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: uint64(size), Max: old.Max})
+  if err != nil {
+    t.Fatal(err)
+  }
+  lift := func() {
+    syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+  }
+  t.Cleanup(lift)
+  return lift
+}
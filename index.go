@@ -0,0 +1,255 @@
+package main
+
+// indexes are the lookups the handlers need on every request, kept next to
+// the cached DBStructure so none of them has to scan every record.
+// they are never persisted: openDB builds them and every write keeps them current
+type indexes struct {
+  userByEmail        map[string]int
+  userByAccessToken  map[string]int
+  userByRefreshToken map[string]int
+  // case-folded handle -> user
+  userByHandle       map[string]int
+  chirpsByAuthor     map[int]map[int]struct{}
+  // author -> their chirps oldest first, see Tx.Timeline
+  authorTimelines    map[int][]pageCursor
+  chirpsByTag        map[string]map[int]struct{}
+  repliesByParent    map[int]map[int]struct{}
+  revisionsByChirp   map[int]map[int]struct{}
+  trashByAuthor      map[int]map[int]struct{}
+  // drafts and scheduled chirps of each author
+  draftsByAuthor     map[int]map[int]struct{}
+  // chirps waiting for their publish_at, see DB.PublishDue
+  scheduled          map[int]struct{}
+  reportsByChirp     map[int]map[int]struct{}
+  openReportsByChirp map[int]map[int]struct{}
+  // chirp:reporter -> open report, see openReportKey
+  openReportByReporter map[string]int
+  subscriptionEventsByUser map[int]map[int]struct{}
+  // Polka event id -> subscription event, see DB.ApplySubscriptionEvent
+  subscriptionEventByPolkaID map[string]int
+  // users whose chirps are hidden while they are suspended
+  chirpsHiddenBySuspension map[int]struct{}
+  // chirps with moderation flags nobody looked at yet
+  flaggedChirps      map[int]struct{}
+  search             *searchIndex
+  notificationsByUser map[int]map[int]struct{}
+  unreadByUser       map[int]int
+  // reaction keys, see reactionKey
+  reactionsByUser    map[int]map[string]struct{}
+  reactionsByChirp   map[int]map[string]struct{}
+  // followee -> followers and follower -> followees
+  followers          map[int]map[int]struct{}
+  following          map[int]map[int]struct{}
+}
+
+func buildIndexes(ds *DBStructure) *indexes {
+  idx := &indexes{
+    userByEmail: map[string]int{},
+    userByAccessToken: map[string]int{},
+    userByRefreshToken: map[string]int{},
+    chirpsByAuthor: map[int]map[int]struct{}{},
+    authorTimelines: map[int][]pageCursor{},
+    chirpsByTag: map[string]map[int]struct{}{},
+    repliesByParent: map[int]map[int]struct{}{},
+    revisionsByChirp: map[int]map[int]struct{}{},
+    trashByAuthor: map[int]map[int]struct{}{},
+    draftsByAuthor: map[int]map[int]struct{}{},
+    scheduled: map[int]struct{}{},
+    reportsByChirp: map[int]map[int]struct{}{},
+    openReportsByChirp: map[int]map[int]struct{}{},
+    openReportByReporter: map[string]int{},
+    flaggedChirps: map[int]struct{}{},
+    chirpsHiddenBySuspension: map[int]struct{}{},
+    subscriptionEventsByUser: map[int]map[int]struct{}{},
+    subscriptionEventByPolkaID: map[string]int{},
+    search: newSearchIndex(),
+    userByHandle: map[string]int{},
+    notificationsByUser: map[int]map[int]struct{}{},
+    unreadByUser: map[int]int{},
+    reactionsByUser: map[int]map[string]struct{}{},
+    reactionsByChirp: map[int]map[string]struct{}{},
+    followers: map[int]map[int]struct{}{},
+    following: map[int]map[int]struct{}{},
+  }
+  for _, user := range ds.Users {
+    idx.add("users", user)
+  }
+  for _, chirp := range ds.Chirps {
+    idx.add("chirps", chirp)
+  }
+  for _, notification := range ds.Notifications {
+    idx.add("notifications", notification)
+  }
+  for _, reaction := range ds.Reactions {
+    idx.add("reactions", reaction)
+  }
+  for _, follow := range ds.Follows {
+    idx.add("follows", follow)
+  }
+  for _, revision := range ds.Revisions {
+    idx.add("revisions", revision)
+  }
+  for _, report := range ds.Reports {
+    idx.add("reports", report)
+  }
+  for _, event := range ds.SubscriptionEvents {
+    idx.add("subscription_events", event)
+  }
+  return idx
+}
+
+// add indexes a record that was just stored in tableName
+func (idx *indexes) add(tableName string, value interface{}) {
+  switch v := value.(type) {
+  case User:
+    setKey(idx.userByEmail, v.Email, v.ID)
+    setKey(idx.userByAccessToken, v.AccessToken, v.ID)
+    setKey(idx.userByRefreshToken, v.RefreshToken, v.ID)
+    setKey(idx.userByHandle, foldCase(v.Handle), v.ID)
+    if v.SuspendedAt != nil && v.SuspensionHidesChirps {
+      idx.chirpsHiddenBySuspension[v.ID] = struct{}{}
+    }
+  case Chirp:
+    // drafts only become replies once they are published
+    if v.InReplyTo != 0 && !v.unpublished() {
+      addToSet(idx.repliesByParent, v.InReplyTo, v.ID)
+    }
+    if v.unpublished() {
+      addToSet(idx.draftsByAuthor, v.Author_ID, v.ID)
+    }
+    if v.Status == chirpScheduled {
+      idx.scheduled[v.ID] = struct{}{}
+    }
+    if len(v.ModerationFlags) > 0 && !v.hidden() {
+      idx.flaggedChirps[v.ID] = struct{}{}
+    }
+    if v.DeletedAt != nil && !v.Deleted {
+      addToSet(idx.trashByAuthor, v.Author_ID, v.ID)
+    }
+    // trashed chirps and tombstones only show up in their thread
+    if v.hidden() {
+      return
+    }
+    addToSet(idx.chirpsByAuthor, v.Author_ID, v.ID)
+    idx.authorTimelines[v.Author_ID] = insertSorted(idx.authorTimelines[v.Author_ID], timelineKey(v))
+    for _, tag := range v.Tags {
+      addToSet(idx.chirpsByTag, tag, v.ID)
+    }
+    idx.search.add(v)
+  case Notification:
+    addToSet(idx.notificationsByUser, v.UserID, v.ID)
+    if v.ReadAt == nil {
+      idx.unreadByUser[v.UserID]++
+    }
+  case Reaction:
+    addToSet(idx.reactionsByUser, v.UserID, v.key())
+    addToSet(idx.reactionsByChirp, v.ChirpID, v.key())
+  case Follow:
+    addToSet(idx.followers, v.FolloweeID, v.FollowerID)
+    addToSet(idx.following, v.FollowerID, v.FolloweeID)
+  case Revision:
+    addToSet(idx.revisionsByChirp, v.ChirpID, v.ID)
+  case SubscriptionEvent:
+    addToSet(idx.subscriptionEventsByUser, v.UserID, v.ID)
+    setKey(idx.subscriptionEventByPolkaID, v.PolkaEventID, v.ID)
+  case Report:
+    addToSet(idx.reportsByChirp, v.ChirpID, v.ID)
+    if v.ResolvedAt == nil {
+      addToSet(idx.openReportsByChirp, v.ChirpID, v.ID)
+      setKey(idx.openReportByReporter, openReportKey(v.ChirpID, v.ReporterID), v.ID)
+    }
+  }
+}
+
+// remove forgets a record that is about to be replaced or deleted
+func (idx *indexes) remove(tableName string, value interface{}) {
+  switch v := value.(type) {
+  case User:
+    unsetKey(idx.userByEmail, v.Email, v.ID)
+    unsetKey(idx.userByAccessToken, v.AccessToken, v.ID)
+    unsetKey(idx.userByRefreshToken, v.RefreshToken, v.ID)
+    unsetKey(idx.userByHandle, foldCase(v.Handle), v.ID)
+    delete(idx.chirpsHiddenBySuspension, v.ID)
+  case Chirp:
+    if v.InReplyTo != 0 && !v.unpublished() {
+      removeFromSet(idx.repliesByParent, v.InReplyTo, v.ID)
+    }
+    if v.unpublished() {
+      removeFromSet(idx.draftsByAuthor, v.Author_ID, v.ID)
+    }
+    delete(idx.scheduled, v.ID)
+    delete(idx.flaggedChirps, v.ID)
+    if v.DeletedAt != nil && !v.Deleted {
+      removeFromSet(idx.trashByAuthor, v.Author_ID, v.ID)
+    }
+    if v.hidden() {
+      return
+    }
+    removeFromSet(idx.chirpsByAuthor, v.Author_ID, v.ID)
+    idx.authorTimelines[v.Author_ID] = removeSorted(idx.authorTimelines[v.Author_ID], timelineKey(v))
+    if len(idx.authorTimelines[v.Author_ID]) == 0 {
+      delete(idx.authorTimelines, v.Author_ID)
+    }
+    for _, tag := range v.Tags {
+      removeFromSet(idx.chirpsByTag, tag, v.ID)
+    }
+    idx.search.remove(v)
+  case Notification:
+    removeFromSet(idx.notificationsByUser, v.UserID, v.ID)
+    if v.ReadAt == nil {
+      idx.unreadByUser[v.UserID]--
+      if idx.unreadByUser[v.UserID] <= 0 {
+        delete(idx.unreadByUser, v.UserID)
+      }
+    }
+  case Reaction:
+    removeFromSet(idx.reactionsByUser, v.UserID, v.key())
+    removeFromSet(idx.reactionsByChirp, v.ChirpID, v.key())
+  case Follow:
+    removeFromSet(idx.followers, v.FolloweeID, v.FollowerID)
+    removeFromSet(idx.following, v.FollowerID, v.FolloweeID)
+  case Revision:
+    removeFromSet(idx.revisionsByChirp, v.ChirpID, v.ID)
+  case SubscriptionEvent:
+    removeFromSet(idx.subscriptionEventsByUser, v.UserID, v.ID)
+    unsetKey(idx.subscriptionEventByPolkaID, v.PolkaEventID, v.ID)
+  case Report:
+    removeFromSet(idx.reportsByChirp, v.ChirpID, v.ID)
+    if v.ResolvedAt == nil {
+      removeFromSet(idx.openReportsByChirp, v.ChirpID, v.ID)
+      unsetKey(idx.openReportByReporter, openReportKey(v.ChirpID, v.ReporterID), v.ID)
+    }
+  }
+}
+
+// empty strings (no token yet) are never indexed
+func setKey(m map[string]int, key string, id int) {
+  if key != "" {
+    m[key] = id
+  }
+}
+
+// only drop the key if it still points at this record
+func unsetKey(m map[string]int, key string, id int) {
+  if key != "" && m[key] == id {
+    delete(m, key)
+  }
+}
+
+func addToSet[K, V comparable](sets map[K]map[V]struct{}, key K, id V) {
+  ids, ok := sets[key]
+  if !ok {
+    ids = map[V]struct{}{}
+    sets[key] = ids
+  }
+  ids[id] = struct{}{}
+}
+
+// removeFromSet drops id and, once the set is empty, the key itself
+func removeFromSet[K, V comparable](sets map[K]map[V]struct{}, key K, id V) {
+  ids := sets[key]
+  delete(ids, id)
+  if len(ids) == 0 {
+    delete(sets, key)
+  }
+}
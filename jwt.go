@@ -9,17 +9,27 @@ import (
   "github.com/golang-jwt/jwt/v5"
 )
 
-func (cfg *apiConfig) jwtCreateToken(issuer string, expireInSeconds int, id int) (string, error) {
+// chirpyClaims are the claims in every token we hand out
+type chirpyClaims struct {
+  // only access tokens carry the role of their user
+  Role string `json:"role,omitempty"`
+  jwt.RegisteredClaims
+}
+
+func (cfg *apiConfig) jwtCreateToken(issuer string, expireInSeconds int, id int, role string) (string, error) {
   // Create a new token object, specifying signing method and the claims
 
   // Calculate the expiration time
   expireDuration := time.Duration(expireInSeconds) * time.Second
 
-  token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-    Issuer: issuer,
-    IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-    ExpiresAt: jwt.NewNumericDate(time.Now().Add(expireDuration).UTC()),
-    Subject: fmt.Sprint(id),
+  token := jwt.NewWithClaims(jwt.SigningMethodHS256, chirpyClaims{
+    Role: role,
+    RegisteredClaims: jwt.RegisteredClaims{
+      Issuer: issuer,
+      IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
+      ExpiresAt: jwt.NewNumericDate(time.Now().Add(expireDuration).UTC()),
+      Subject: fmt.Sprint(id),
+    },
   })
 
   // Sign and get the complete encoded token as a string using the secret
@@ -31,9 +41,9 @@ func (cfg *apiConfig) jwtCreateToken(issuer string, expireInSeconds int, id int)
   return tokenString, nil
 }
 
-func (cfg *apiConfig) jwtCreateAccessToken(id int) (string, error) {
+func (cfg *apiConfig) jwtCreateAccessToken(id int, role string) (string, error) {
   // access tokens have 1 hour 
-  token, err := cfg.jwtCreateToken("chirpy-access", 3600, id)
+  token, err := cfg.jwtCreateToken("chirpy-access", 3600, id, role)
   if err != nil {
     return "", err
   }
@@ -41,7 +51,7 @@ func (cfg *apiConfig) jwtCreateAccessToken(id int) (string, error) {
 }
 func (cfg *apiConfig) jwtCreateRefreshToken(id int) (string, error) {
   // refresh tokens have 60 days = 
-  token, err := cfg.jwtCreateToken("chirpy-refresh", 60 * 24 * 3600, id)
+  token, err := cfg.jwtCreateToken("chirpy-refresh", 60 * 24 * 3600, id, "")
   if err != nil {
     return "", err
   }
@@ -104,6 +114,21 @@ func GetIssuer(tokenString, tokenSecret string) (string, error) {
   return issuerString, nil
 }
 
+// ParseClaims validates a token and returns all of its claims at once
+func ParseClaims(tokenString, tokenSecret string) (chirpyClaims, error) {
+  claimsStruct := chirpyClaims{}
+  _, err := jwt.ParseWithClaims(
+    tokenString,
+    &claimsStruct,
+    func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+  )
+  if err != nil {
+    return chirpyClaims{}, err
+  }
+
+  return claimsStruct, nil
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
   authHeader := headers.Get("Authorization")
   if authHeader == "" {
@@ -0,0 +1,74 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "regexp"
+  "strconv"
+
+  "github.com/rivo/uniseg"
+)
+
+// links count this much towards the limit however long they are, so
+// nobody has to shorten them first
+const urlLength = 23
+
+// the account tiers with a chirp length limit of their own
+const (
+  tierFree = "free"
+  tierRed  = "red"
+)
+
+var urlPattern = regexp.MustCompile(`https?://\S+`)
+
+// chirpLength is how long a chirp is as its readers see it: in grapheme
+// clusters, so an emoji or an accented letter is one character however many
+// bytes or code points it takes, and with every link counting as urlLength
+func chirpLength(body string) int {
+  links := urlPattern.FindAllStringIndex(body, -1)
+  length := len(links) * urlLength
+  start := 0
+  for _, link := range links {
+    length += uniseg.GraphemeClusterCount(body[start:link[0]])
+    start = link[1]
+  }
+  return length + uniseg.GraphemeClusterCount(body[start:])
+}
+
+// tier is the account tier whose limits apply to the user
+func (u User) tier() string {
+  if u.entitled(featureLongChirps, now()) {
+    return tierRed
+  }
+  return tierFree
+}
+
+// chirpLimit is the longest chirp author may post; tiers without a limit
+// of their own get the free one
+func (cfg *apiConfig) chirpLimit(author User) int {
+  if limit, ok := cfg.chirpLimits[author.tier()]; ok {
+    return limit
+  }
+  return chirpCharLimit
+}
+
+// loadChirpLimits returns the chirp length limit of every tier; CHIRP_LIMIT_FREE
+// and CHIRP_LIMIT_RED override the defaults
+func loadChirpLimits() (map[string]int, error) {
+  limits := map[string]int{
+    tierFree: chirpCharLimit,
+    tierRed:  redChirpCharLimit,
+  }
+  for tier, name := range map[string]string{tierFree: "CHIRP_LIMIT_FREE", tierRed: "CHIRP_LIMIT_RED"} {
+    value := os.Getenv(name)
+    if value == "" {
+      continue
+    }
+    limit, err := strconv.Atoi(value)
+    if err != nil || limit <= 0 {
+      return nil, fmt.Errorf("%s must be a positive number of characters", name)
+    }
+    limits[tier] = limit
+  }
+  return limits, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestChirpLength(t *testing.T) {
+  for _, tc := range []struct {
+    body string
+    want int
+  }{
+    {"hello", 5},
+    // a family and a flag are single characters built from several code points
+    {"\U0001F468\u200d\U0001F469\u200d\U0001F467", 1},
+    {"\U0001F1F7\U0001F1F4", 1},
+    {"\U0001F44D\U0001F3FD", 1},
+    // so is a letter with a combining accent
+    {"cafe\u0301", 4},
+    // links count as urlLength however long they are
+    {"http://x.co", urlLength},
+    {"see https://example.com/" + strings.Repeat("a", 200) + " now", 4 + urlLength + 4},
+    {"http://a.io http://b.io", 2*urlLength + 1},
+  } {
+    if got := chirpLength(tc.body); got != tc.want {
+      t.Errorf("chirpLength(%q) = %d, want %d", tc.body, got, tc.want)
+    }
+  }
+}
+
+func TestChirpLimitDefaultsToTheFreeOne(t *testing.T) {
+  cfg := &apiConfig{moderator: moderationPipeline{}}
+  if limit := cfg.chirpLimit(User{}); limit != chirpCharLimit {
+    t.Fatalf("limit without any configured = %d", limit)
+  }
+  cfg.chirpLimits = map[string]int{tierRed: redChirpCharLimit}
+  if limit := cfg.chirpLimit(User{}); limit != chirpCharLimit {
+    t.Fatalf("limit of a tier not configured = %d", limit)
+  }
+  if _, err := cfg.validateChirp(strings.Repeat("a", chirpCharLimit+1), User{}); err == nil {
+    t.Fatal("chirp over the default limit was accepted")
+  }
+}
+
+func TestChirpLimitsFollowTheTier(t *testing.T) {
+  cfg, h := newTestAPI(t)
+  alice := signUp(t, h, "alice@example.com")
+  post := func(length int) int {
+    body := `{"body": "` + strings.Repeat("a", length) + `"}`
+    return request(t, h, "POST", "/api/chirps", alice.Token, body).Code
+  }
+
+  if code := post(chirpCharLimit); code != http.StatusCreated {
+    t.Fatalf("free chirp at the limit: %d", code)
+  }
+  if code := post(chirpCharLimit + 1); code != http.StatusBadRequest {
+    t.Fatalf("free chirp over the limit: %d", code)
+  }
+
+  _, err := cfg.DB.ApplySubscriptionEvent(alice.ID, polkaUserUpgraded, "", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if code := post(redChirpCharLimit); code != http.StatusCreated {
+    t.Fatalf("red chirp at the limit: %d", code)
+  }
+  if code := post(redChirpCharLimit + 1); code != http.StatusBadRequest {
+    t.Fatalf("red chirp over the limit: %d", code)
+  }
+}
@@ -4,19 +4,29 @@ import (
   "log"
   "net/http"
   "os"
+  "time"
   "github.com/joho/godotenv"
 )
 
 const filepathRoot = "."
 const port = "8080"
+// chirp length limits per tier, see loadChirpLimits
 const chirpCharLimit = 140
+const redChirpCharLimit = 280
 const dbPath = "database.json"
+const moderationWordsPath = "moderation_words.txt"
 
 type apiConfig struct { 
   fileserverHits int
   DB             *DB
   jwtSecret       string
   polkaAPIKey     string
+  trashRetention  time.Duration
+  moderator       Moderator
+  // tier -> longest chirp allowed, see chirpLength
+  chirpLimits     map[string]int
+  // DB_ENCRYPTION_NEW_KEY when the server started, see handlerRotateKey
+  newEncryptionKey []byte
 }
 
 func middlewareCors(next http.Handler) http.Handler {
@@ -46,11 +56,48 @@ func main() {
   }
   jwtSecret := os.Getenv("JWT_SECRET")
   polkaAPIKey := os.Getenv("POLKA_API_KEY")
+  trashRetention := defaultTrashRetention
+  if retention := os.Getenv("CHIRP_TRASH_RETENTION"); retention != "" {
+    trashRetention, err = time.ParseDuration(retention)
+    if err != nil || trashRetention <= 0 {
+      log.Fatal("CHIRP_TRASH_RETENTION must be a positive duration like 720h")
+    }
+  }
+  chirpLimits, err := loadChirpLimits()
+  if err != nil {
+    log.Fatal(err)
+  }
+  wordsPath := os.Getenv("MODERATION_WORDS_FILE")
+  if wordsPath == "" {
+    wordsPath = moderationWordsPath
+  }
+  path := os.Getenv("DB_PATH")
+  if path == "" {
+    path = dbPath
+  }
 
-  mux := http.NewServeMux() 
+  // chirpy migrate ..., chirpy import ... etc.
+  if len(os.Args) > 1 {
+    err := runCommand(path, os.Args[1:])
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
 
+  db, err := openConfiguredDB(path)
+  if err != nil {
+    log.Fatal(err)
+  }
+  var newEncryptionKey []byte
+  if value := os.Getenv("DB_ENCRYPTION_NEW_KEY"); value != "" {
+    newEncryptionKey, err = parseEncryptionKey(value)
+    if err != nil {
+      log.Fatal("DB_ENCRYPTION_NEW_KEY: ", err)
+    }
+  }
 
-  db, err := NewDB("database.json")
+  words, err := newWordList(wordsPath)
   if err != nil {
     log.Fatal(err)
   }
@@ -60,40 +107,95 @@ func main() {
     DB: db,
     jwtSecret: jwtSecret,
     polkaAPIKey: polkaAPIKey,
+    trashRetention: trashRetention,
+    // stages run in this order
+    moderator: moderationPipeline{words},
+    chirpLimits: chirpLimits,
+    newEncryptionKey: newEncryptionKey,
   }
-
-  // or http.Dir("./app")
-  mux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
-  mux.HandleFunc("GET /api/healthz", healthHandler)
-  mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
-  mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
-
-  mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsCreate)
-  mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsRetrieve)
-
-  mux.HandleFunc("GET /api/chirps/{id}", apiCfg.handlerChirpsRetrieveById)
-  mux.HandleFunc("DELETE /api/chirps/{id}", apiCfg.handlerChirpsDeleteById)
-
-  mux.HandleFunc("POST /api/users", apiCfg.handlerUserCreate)
-  mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersUpdate)
-  mux.HandleFunc("GET /api/users/{id}", apiCfg.handlerUsersRetrieveById)
-
-  mux.HandleFunc("POST /api/login", apiCfg.handlerUserLogin)
-  mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
-  mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokeToken)
-
-  mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerUserUpgradeToRed)
-
-  // wrap the mux to add CORS 
-  corsMux := middlewareCors(mux)
+  // look often enough that nothing outstays its retention by much
+  go apiCfg.runTrashJanitor(min(trashRetention / 10, time.Hour))
+  go apiCfg.runScheduler(schedulerInterval)
 
   // don't use http.HandleFunc; instead create instance and assign the handler like this:
   server := &http.Server {
     Addr:    ":" + port,
-    Handler: corsMux,
+    Handler: apiCfg.routes(),
   }
 
   log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
   // log.Fatal(http.ListenAndServe(":8080", nil)) becomes:
   log.Fatal(server.ListenAndServe())
 }
+
+// routes registers every endpoint; the returned handler adds CORS to all of them
+func (cfg *apiConfig) routes() http.Handler {
+  mux := http.NewServeMux()
+
+  // or http.Dir("./app")
+  mux.Handle("/app/", cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
+  mux.HandleFunc("GET /api/healthz", healthHandler)
+  mux.Handle("GET /api/reset", cfg.middlewareRequireRole(roleAdmin, cfg.handlerReset))
+
+  // everything under /admin/ is behind a login with at least the moderator
+  // role, so a route added here without its own check is never open to anyone
+  admin := http.NewServeMux()
+  admin.Handle("GET /admin/metrics", cfg.middlewareRequireRole(roleAdmin, cfg.handlerMetrics))
+  admin.Handle("GET /admin/backup", cfg.middlewareRequireRole(roleAdmin, cfg.handlerBackup))
+  admin.Handle("POST /admin/rotate-key", cfg.middlewareRequireRole(roleAdmin, cfg.handlerRotateKey))
+  admin.Handle("PUT /admin/users/{id}/role", cfg.middlewareRequireRole(roleAdmin, cfg.handlerUsersSetRole))
+  admin.Handle("POST /admin/users/{id}/suspension", cfg.middlewareRequireRole(roleAdmin, cfg.handlerUsersSuspend))
+  admin.Handle("DELETE /admin/users/{id}/suspension", cfg.middlewareRequireRole(roleAdmin, cfg.handlerUsersUnsuspend))
+  admin.HandleFunc("GET /admin/moderation", cfg.handlerModerationQueue)
+  admin.HandleFunc("GET /admin/moderation/actions", cfg.handlerModerationActions)
+  admin.HandleFunc("POST /admin/moderation/{id}", cfg.handlerModerationAct)
+  mux.Handle("/admin/", cfg.middlewareRequireRole(roleModerator, admin.ServeHTTP))
+
+  mux.HandleFunc("POST /api/chirps", cfg.handlerChirpsCreate)
+  mux.HandleFunc("GET /api/chirps", cfg.handlerChirpsRetrieve)
+  mux.HandleFunc("GET /api/chirps/search", cfg.handlerChirpsSearch)
+
+  mux.HandleFunc("GET /api/chirps/{id}", cfg.handlerChirpsRetrieveById)
+  mux.HandleFunc("PUT /api/chirps/{id}", cfg.handlerChirpsUpdate)
+  mux.HandleFunc("DELETE /api/chirps/{id}", cfg.handlerChirpsDeleteById)
+  mux.HandleFunc("GET /api/chirps/{id}/revisions", cfg.handlerChirpRevisions)
+  mux.HandleFunc("POST /api/chirps/{id}/report", cfg.handlerChirpsReport)
+  mux.HandleFunc("POST /api/chirps/{id}/restore", cfg.handlerChirpsRestore)
+  mux.HandleFunc("GET /api/trash", cfg.handlerTrashRetrieve)
+  mux.HandleFunc("GET /api/drafts", cfg.handlerDraftsRetrieve)
+  mux.HandleFunc("PUT /api/drafts/{id}", cfg.handlerDraftsUpdate)
+  mux.HandleFunc("DELETE /api/drafts/{id}", cfg.handlerDraftsDelete)
+  mux.HandleFunc("GET /api/chirps/{id}/thread", cfg.handlerChirpThread)
+  mux.HandleFunc("POST /api/chirps/{id}/like", cfg.handlerChirpsLike)
+  mux.HandleFunc("DELETE /api/chirps/{id}/like", cfg.handlerChirpsLike)
+  mux.HandleFunc("POST /api/chirps/{id}/rechirp", cfg.handlerChirpsRechirp)
+  mux.HandleFunc("DELETE /api/chirps/{id}/rechirp", cfg.handlerChirpsRechirp)
+
+  mux.HandleFunc("GET /api/tags/trending", cfg.handlerTagsTrending)
+  mux.HandleFunc("GET /api/tags/{tag}/chirps", cfg.handlerTagChirps)
+
+  mux.HandleFunc("POST /api/users", cfg.handlerUserCreate)
+  mux.HandleFunc("PUT /api/users", cfg.handlerUsersUpdate)
+  mux.HandleFunc("GET /api/users/{id}", cfg.handlerUsersRetrieveById)
+  mux.HandleFunc("GET /api/users/{id}/likes", cfg.handlerUserLikes)
+  mux.HandleFunc("POST /api/users/{id}/follow", cfg.handlerUsersFollow)
+  mux.HandleFunc("DELETE /api/users/{id}/follow", cfg.handlerUsersFollow)
+  mux.HandleFunc("GET /api/users/{id}/followers", cfg.handlerUsersFollowers)
+  mux.HandleFunc("GET /api/users/{id}/following", cfg.handlerUsersFollowing)
+  mux.HandleFunc("GET /api/timeline", cfg.handlerTimeline)
+  mux.HandleFunc("GET /api/subscription", cfg.handlerSubscriptionRetrieve)
+
+  mux.HandleFunc("GET /api/notifications", cfg.handlerNotificationsRetrieve)
+  mux.HandleFunc("GET /api/notifications/unread_count", cfg.handlerNotificationsUnreadCount)
+  mux.HandleFunc("POST /api/notifications/read", cfg.handlerNotificationsMarkRead)
+  mux.HandleFunc("POST /api/notifications/{id}/read", cfg.handlerNotificationsMarkRead)
+
+  mux.HandleFunc("POST /api/login", cfg.handlerUserLogin)
+  mux.HandleFunc("POST /api/refresh", cfg.handlerRefreshToken)
+  mux.HandleFunc("POST /api/revoke", cfg.handlerRevokeToken)
+
+  mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerPolkaWebhooks)
+
+  // wrap the mux to add CORS 
+  return middlewareCors(mux)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "errors"
+  "strings"
+  "unicode"
+)
+
+const maxHandleLength = 30
+
+// Mention is an @mention in a chirp body that resolved to a user.
+// Start and End are rune offsets of the mention text, @ included
+type Mention struct {
+  UserID int    `json:"user_id"`
+  Text   string `json:"text"`
+  Start  int    `json:"start"`
+  End    int    `json:"end"`
+}
+
+// validateHandle checks the shape of a handle: letters, digits and underscores
+func validateHandle(handle string) error {
+  if handle == "" || len(handle) > maxHandleLength {
+    return errors.New("handle must be 1 to 30 characters long")
+  }
+  for _, r := range handle {
+    if r > unicode.MaxASCII || !isTagRune(r) {
+      return errors.New("handle may only contain letters, digits and underscores")
+    }
+  }
+  return nil
+}
+
+// mentionCandidate is an @word in a body before it is resolved to a user
+type mentionCandidate struct {
+  text  string
+  start int
+  end   int
+}
+
+// findMentions returns every @handle and @name@example.com in body.
+// the @ must not follow a word character, so plain emails are not mentions
+func findMentions(body string) []mentionCandidate {
+  candidates := []mentionCandidate{}
+  runes := []rune(body)
+  for i := 0; i < len(runes); i++ {
+    if runes[i] != '@' || (i > 0 && isTagRune(runes[i-1])) {
+      continue
+    }
+    end := i + 1
+    for end < len(runes) && isMentionRune(runes[end]) {
+      end++
+    }
+    // "@bob." or "@bob@example.com," at the end of a sentence
+    for end > i+1 && strings.ContainsRune(".-@", runes[end-1]) {
+      end--
+    }
+    if end > i+1 {
+      candidates = append(candidates, mentionCandidate{
+        text: string(runes[i:end]),
+        start: i,
+        end: end,
+      })
+    }
+    i = end - 1
+  }
+  return candidates
+}
+
+func isMentionRune(r rune) bool {
+  return isTagRune(r) || strings.ContainsRune(".+-@", r)
+}
+
+// ResolveMentions turns the @mentions of body into Mentions; anything that
+// is not a known handle or email stays plain text
+func (tx *Tx) ResolveMentions(body string) []Mention {
+  mentions := []Mention{}
+  for _, c := range findMentions(body) {
+    name := c.text[1:]
+    var user User
+    var ok bool
+    if strings.Contains(name, "@") {
+      user, ok = tx.UserByEmail(name)
+    } else {
+      user, ok = tx.UserByHandle(name)
+    }
+    if !ok {
+      continue
+    }
+    mentions = append(mentions, Mention{
+      UserID: user.ID,
+      Text: c.text,
+      Start: c.start,
+      End: c.end,
+    })
+  }
+  return mentions
+}
+
+func (tx *Tx) UserByHandle(handle string) (User, bool) {
+  return tx.userByIndex(tx.db.idx.userByHandle, foldCase(handle))
+}
+
+func (db *DB) FindUserByHandle(handle string) (User, error) {
+  user := User{}
+  err := db.View(func(tx *Tx) error {
+    user, _ = tx.UserByHandle(handle)
+    return nil
+  })
+  return user, err
+}
+
+// SetUserHandle gives the user a new handle; handles are unique regardless of case
+func (db *DB) SetUserHandle(userId int, handle string) (User, error) {
+  err := validateHandle(handle)
+  if err != nil {
+    return User{}, err
+  }
+  user := User{}
+  err = db.Update(func(tx *Tx) error {
+    if other, ok := tx.UserByHandle(handle); ok && other.ID != userId {
+      return errHandleTaken
+    }
+    var ok bool
+    user, ok = tx.User(userId)
+    if !ok {
+      return errors.New("user not found")
+    }
+    user.Handle = handle
+    user.UpdatedAt = now()
+    return tx.PutUser(user)
+  })
+  if err != nil {
+    return User{}, err
+  }
+  return user, nil
+}
+
+var errHandleTaken = errors.New("this handle is already used")
@@ -0,0 +1,253 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "time"
+)
+
+// migration is one versioned step of the sqlite schema.
+// migrations are forward-only: once released, a migration is never edited,
+// a new one is appended instead. down only exists to step back during development
+type migration struct {
+  version int
+  name    string
+  up      string
+  down    string
+}
+
+// every table keeps the record as json in data, keyed the same way
+// the mutations are. nothing is looked up with SQL, see sqlStorage, so
+// the tables have no columns or indexes beyond that
+var migrations = []migration{
+  {
+    version: 1,
+    name: "create users",
+    up: `CREATE TABLE users (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE users;`,
+  },
+  {
+    version: 2,
+    name: "create chirps",
+    up: `CREATE TABLE chirps (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE chirps;`,
+  },
+  {
+    version: 3,
+    name: "create sequences",
+    up: `CREATE TABLE sequences (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE sequences;`,
+  },
+  {
+    version: 4,
+    name: "create notifications",
+    up: `CREATE TABLE notifications (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE notifications;`,
+  },
+  {
+    version: 5,
+    name: "create reactions",
+    up: `CREATE TABLE reactions (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE reactions;`,
+  },
+  {
+    version: 6,
+    name: "create follows",
+    up: `CREATE TABLE follows (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE follows;`,
+  },
+  {
+    version: 7,
+    name: "create revisions",
+    up: `CREATE TABLE revisions (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE revisions;`,
+  },
+  {
+    version: 8,
+    name: "create chirp flags",
+    up: `CREATE TABLE chirp_flags (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE chirp_flags;`,
+  },
+  {
+    version: 9,
+    name: "create reports",
+    up: `CREATE TABLE reports (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE reports;`,
+  },
+  {
+    version: 10,
+    name: "create moderation actions",
+    up: `CREATE TABLE moderation_actions (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE moderation_actions;`,
+  },
+  {
+    version: 11,
+    name: "create subscription events",
+    up: `CREATE TABLE subscription_events (
+      key  TEXT PRIMARY KEY,
+      data TEXT NOT NULL
+    );`,
+    down: `DROP TABLE subscription_events;`,
+  },
+}
+
+type migrationStatus struct {
+  migration
+  appliedAt time.Time
+  applied   bool
+}
+
+func ensureMigrationsTable(conn *sql.DB) error {
+  _, err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at TEXT NOT NULL
+  )`)
+  return err
+}
+
+// schemaVersion returns the highest migration applied to conn, 0 for a fresh database
+func schemaVersion(conn *sql.DB) (int, error) {
+  err := ensureMigrationsTable(conn)
+  if err != nil {
+    return 0, err
+  }
+  var version sql.NullInt64
+  err = conn.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+  if err != nil {
+    return 0, err
+  }
+  return int(version.Int64), nil
+}
+
+// migrateUp applies every pending migration, each in its own transaction
+func migrateUp(conn *sql.DB) ([]migration, error) {
+  current, err := schemaVersion(conn)
+  if err != nil {
+    return nil, err
+  }
+
+  applied := []migration{}
+  for _, m := range migrations {
+    if m.version <= current {
+      continue
+    }
+    err := runMigration(conn, m, m.up, func(tx *sql.Tx) error {
+      _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+        m.version, m.name, time.Now().UTC().Format(time.RFC3339))
+      return err
+    })
+    if err != nil {
+      return applied, err
+    }
+    applied = append(applied, m)
+  }
+  return applied, nil
+}
+
+// migrateDown reverts the latest applied migration
+func migrateDown(conn *sql.DB) (migration, error) {
+  current, err := schemaVersion(conn)
+  if err != nil {
+    return migration{}, err
+  }
+  if current == 0 {
+    return migration{}, errors.New("no migrations to revert")
+  }
+
+  for _, m := range migrations {
+    if m.version != current {
+      continue
+    }
+    err := runMigration(conn, m, m.down, func(tx *sql.Tx) error {
+      _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+      return err
+    })
+    return m, err
+  }
+  return migration{}, fmt.Errorf("database is at unknown schema version %d", current)
+}
+
+func runMigration(conn *sql.DB, m migration, stmt string, record func(tx *sql.Tx) error) error {
+  tx, err := conn.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  _, err = tx.Exec(stmt)
+  if err != nil {
+    return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+  }
+  err = record(tx)
+  if err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+// getMigrationStatus lists every known migration and whether it was applied
+func getMigrationStatus(conn *sql.DB) ([]migrationStatus, error) {
+  err := ensureMigrationsTable(conn)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  appliedAt := map[int]time.Time{}
+  for rows.Next() {
+    var version int
+    var at string
+    err := rows.Scan(&version, &at)
+    if err != nil {
+      return nil, err
+    }
+    appliedAt[version], _ = time.Parse(time.RFC3339, at)
+  }
+  if err := rows.Err(); err != nil {
+    return nil, err
+  }
+
+  statuses := make([]migrationStatus, 0, len(migrations))
+  for _, m := range migrations {
+    at, ok := appliedAt[m.version]
+    statuses = append(statuses, migrationStatus{migration: m, appliedAt: at, applied: ok})
+  }
+  return statuses, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+  "path/filepath"
+  "testing"
+)
+
+func TestMigrationsStepBackAndForth(t *testing.T) {
+  conn, err := openSQLConn(filepath.Join(t.TempDir(), "database.db"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+
+  _, err = migrateUp(conn)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // every down has to undo its up exactly, or the next up fails
+  for range migrations {
+    _, err := migrateDown(conn)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  applied, err := migrateUp(conn)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(applied) != len(migrations) {
+    t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+  }
+
+  // a table for every one the storages know, with just the key and the record
+  for _, table := range tables {
+    var columns int
+    err = conn.QueryRow(`SELECT count(*) FROM pragma_table_info(?)`, table.name).Scan(&columns)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if columns != 2 {
+      t.Fatalf("%s has %d columns, want 2", table.name, columns)
+    }
+  }
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "slices"
+  "strings"
+  "sync"
+  "time"
+  "unicode"
+
+  "golang.org/x/text/unicode/norm"
+)
+
+// what a word-list rule does to a chirp that uses its word
+const (
+  ruleMask   = "mask"
+  ruleReject = "reject"
+  ruleFlag   = "flag"
+)
+
+// how often the word list looks at its file for changes
+const wordListReloadInterval = time.Second
+
+var errChirpRejected = errors.New("Chirp contains a word that is not allowed")
+
+// Moderation is a chirp body on its way through the moderation pipeline
+type Moderation struct {
+  Body string
+  // why a human should take a look; the chirp is still published
+  Flags []string
+}
+
+// ChirpFlags are the moderation flags of one chirp. they are a record of
+// their own so chirps can be sent as they are stored without showing them
+type ChirpFlags struct {
+  ChirpID int      `json:"chirp_id"`
+  Flags   []string `json:"flags"`
+}
+
+// attachChirpFlags puts the stored flags back on their chirps after a load
+func (ds *DBStructure) attachChirpFlags() {
+  for id, flags := range ds.ChirpFlags {
+    if chirp, ok := ds.Chirps[id]; ok {
+      chirp.ModerationFlags = flags.Flags
+      ds.Chirps[id] = chirp
+    }
+  }
+}
+
+// putChirpFlags stores the flags of a chirp, or drops them when there are none
+func (tx *Tx) putChirpFlags(chirpId int, flags []string) error {
+  stored, ok := tx.db.data.ChirpFlags[chirpId]
+  if len(flags) == 0 {
+    if !ok {
+      return nil
+    }
+    return tx.write(deleteRecord("chirp_flags", chirpId))
+  }
+  if ok && slices.Equal(stored.Flags, flags) {
+    return nil
+  }
+  return tx.write(putRecord("chirp_flags", chirpId, ChirpFlags{ChirpID: chirpId, Flags: flags}))
+}
+
+// Moderator is one stage of the moderation pipeline. it may rewrite
+// m.Body, add flags, or reject the chirp by returning an error
+type Moderator interface {
+  Moderate(m *Moderation) error
+}
+
+// moderationPipeline runs its stages in order; the first one that rejects stops it
+type moderationPipeline []Moderator
+
+func (p moderationPipeline) Moderate(m *Moderation) error {
+  for _, stage := range p {
+    err := stage.Moderate(m)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the words every chirpy instance masks when there is no word list file
+var defaultWordRules = map[string]string{
+  "kerfuffle": ruleMask,
+  "sharbert":  ruleMask,
+  "fornax":    ruleMask,
+}
+
+// leetspeak stand-ins for letters
+var leetLetters = map[rune]rune{
+  '0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+  '@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+}
+
+// normalizeWord reduces a word to the form rules are matched in: compatibility
+// characters and accents are taken apart (ｋéｒ -> ker), leetspeak is read as
+// letters (k3rfuffl3 -> kerfuffle) and case is folded
+func normalizeWord(word string) string {
+  b := strings.Builder{}
+  for _, r := range norm.NFKD.String(word) {
+    if unicode.Is(unicode.Mn, r) {
+      continue
+    }
+    if letter, ok := leetLetters[r]; ok {
+      r = letter
+    }
+    b.WriteRune(r)
+  }
+  return foldCase(b.String())
+}
+
+func isWordRune(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// parseWordRules reads one rule per line: a word and optionally what to do
+// with it (mask when left out). blank lines and lines starting with # are skipped
+//
+//   kerfuffle
+//   fornax  reject
+//   sharbert flag
+func parseWordRules(r io.Reader) (map[string]string, error) {
+  rules := map[string]string{}
+  scanner := bufio.NewScanner(r)
+  for line := 1; scanner.Scan(); line++ {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+      continue
+    }
+    action := ruleMask
+    if len(fields) > 1 {
+      action = fields[1]
+    }
+    if len(fields) > 2 || (action != ruleMask && action != ruleReject && action != ruleFlag) {
+      return nil, fmt.Errorf("line %d: expected a word followed by mask, reject or flag", line)
+    }
+    rules[normalizeWord(fields[0])] = action
+  }
+  return rules, scanner.Err()
+}
+
+// wordList is the moderation stage that matches words against a list of
+// rules. the list comes from a file and is reloaded whenever the file
+// changes; a file that does not parse is logged and the old rules kept
+type wordList struct {
+  path string
+
+  mu        sync.Mutex
+  rules     map[string]string
+  modTime   time.Time
+  checkedAt time.Time
+}
+
+// newWordList loads the rules in path, or the default ones while there is no such file
+func newWordList(path string) (*wordList, error) {
+  l := &wordList{path: path, rules: defaultWordRules}
+  err := l.reload()
+  if errors.Is(err, os.ErrNotExist) {
+    return l, nil
+  }
+  return l, err
+}
+
+func (l *wordList) reload() error {
+  info, err := os.Stat(l.path)
+  if err != nil {
+    return err
+  }
+  if info.ModTime().Equal(l.modTime) {
+    return nil
+  }
+
+  f, err := os.Open(l.path)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  rules, err := parseWordRules(f)
+  if err != nil {
+    return fmt.Errorf("%s: %w", l.path, err)
+  }
+  l.rules = rules
+  l.modTime = info.ModTime()
+  return nil
+}
+
+// current returns the rules, reloading them first if it is time to look at the file again
+func (l *wordList) current() map[string]string {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if time.Since(l.checkedAt) >= wordListReloadInterval {
+    l.checkedAt = time.Now()
+    err := l.reload()
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+      log.Printf("Keeping the old word list: %s", err)
+    }
+  }
+  return l.rules
+}
+
+// Moderate looks at every word of the body, both as written and without
+// the punctuation around it, so "Kerfuffle!" and "$harbert" are caught;
+// masked words keep that punctuation ("****!")
+func (l *wordList) Moderate(m *Moderation) error {
+  rules := l.current()
+  runes := []rune(m.Body)
+  out := make([]rune, 0, len(runes))
+
+  for i := 0; i < len(runes); {
+    if unicode.IsSpace(runes[i]) {
+      out = append(out, runes[i])
+      i++
+      continue
+    }
+    end := i
+    for end < len(runes) && !unicode.IsSpace(runes[end]) {
+      end++
+    }
+
+    // the word without its punctuation first, then all of it
+    start, stop := i, end
+    for start < stop && !isWordRune(runes[start]) {
+      start++
+    }
+    for stop > start && !isWordRune(runes[stop-1]) {
+      stop--
+    }
+    action, ok := rules[normalizeWord(string(runes[start:stop]))]
+    if !ok {
+      start, stop = i, end
+      action, ok = rules[normalizeWord(string(runes[start:stop]))]
+    }
+
+    switch {
+    case !ok:
+      out = append(out, runes[i:end]...)
+    case action == ruleReject:
+      return errChirpRejected
+    case action == ruleFlag:
+      m.Flags = append(m.Flags, "flagged word: "+string(runes[start:stop]))
+      out = append(out, runes[i:end]...)
+    default:
+      out = append(out, runes[i:start]...)
+      out = append(out, []rune("****")...)
+      out = append(out, runes[stop:end]...)
+    }
+    i = end
+  }
+
+  m.Body = string(out)
+  return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// what a moderator can do about a chirp in the queue
+const (
+  actionHide    = "hide"
+  actionDismiss = "dismiss"
+  actionSuspend = "suspend"
+)
+
+// a moderator can only suspend users below them, so nobody bans their peers or an admin
+var errSuspendNotBelow = errors.New("You can only suspend users whose role is below yours")
+
+// ModerationAction records what a moderator did about a chirp and why
+type ModerationAction struct {
+  ID          int       `json:"id"`
+  ChirpID     int       `json:"chirp_id"`
+  AuthorID    int       `json:"author_id"`
+  ModeratorID int       `json:"moderator_id"`
+  Action      string    `json:"action"`
+  Note        string    `json:"note"`
+  // what brought the chirp into the queue
+  Reports     int       `json:"reports"`
+  Flags       []string  `json:"flags"`
+  CreatedAt   time.Time `json:"created_at"`
+}
+
+// moderationQueueItem is one chirp waiting for a moderator, with everything
+// reported or flagged about it
+type moderationQueueItem struct {
+  Chirp       Chirp     `json:"chirp"`
+  Flags       []string  `json:"flags"`
+  ReportCount int       `json:"report_count"`
+  Reports     []Report  `json:"reports"`
+  // when the chirp first needed a look
+  QueuedAt    time.Time `json:"queued_at"`
+}
+
+// ModerationQueue returns every chirp with open reports or moderation flags, in no particular order
+func (tx *Tx) ModerationQueue() []moderationQueueItem {
+  queued := map[int]bool{}
+  for chirpId := range tx.db.idx.openReportsByChirp {
+    queued[chirpId] = true
+  }
+  for chirpId := range tx.db.idx.flaggedChirps {
+    queued[chirpId] = true
+  }
+
+  items := make([]moderationQueueItem, 0, len(queued))
+  for chirpId := range queued {
+    chirp := tx.db.data.Chirps[chirpId]
+    item := moderationQueueItem{Chirp: chirp, Flags: chirp.ModerationFlags, Reports: tx.OpenReports(chirpId)}
+    if item.Flags == nil {
+      item.Flags = []string{}
+    }
+    item.ReportCount = len(item.Reports)
+    sortBy(item.Reports, func(r Report) pageCursor { return pageCursor{ID: r.ID} }, idAscending)
+
+    // flagged when it was last written, or reported, whichever came first
+    if len(chirp.ModerationFlags) > 0 {
+      item.QueuedAt = chirp.UpdatedAt
+    }
+    if item.ReportCount > 0 && (item.QueuedAt.IsZero() || item.Reports[0].CreatedAt.Before(item.QueuedAt)) {
+      item.QueuedAt = item.Reports[0].CreatedAt
+    }
+    items = append(items, item)
+  }
+  return items
+}
+
+func (tx *Tx) ModerationActions() []ModerationAction {
+  actions := make([]ModerationAction, 0, len(tx.db.data.ModerationActions))
+  for _, action := range tx.db.data.ModerationActions {
+    actions = append(actions, action)
+  }
+  return actions
+}
+
+func (tx *Tx) PutModerationAction(action ModerationAction) error {
+  return tx.write(putRecord("moderation_actions", action.ID, action))
+}
+
+func (db *DB) GetModerationQueue() ([]moderationQueueItem, error) {
+  items := []moderationQueueItem{}
+  err := db.View(func(tx *Tx) error {
+    items = tx.ModerationQueue()
+    return nil
+  })
+  return items, err
+}
+
+func (db *DB) GetModerationActions() ([]ModerationAction, error) {
+  actions := []ModerationAction{}
+  err := db.View(func(tx *Tx) error {
+    actions = tx.ModerationActions()
+    return nil
+  })
+  return actions, err
+}
+
+// ModerateChirp carries out a moderator's decision on a chirp, records it
+// and takes the chirp out of the queue. hiding takes the chirp out of
+// every listing at once; suspending also hides it and suspends its author
+func (db *DB) ModerateChirp(chirpId int, moderator User, action string, note string) (ModerationAction, error) {
+  record := ModerationAction{}
+  err := db.Update(func(tx *Tx) error {
+    chirp, ok := tx.Chirp(chirpId)
+    if !ok {
+      return errors.New("chirp not found")
+    }
+    if action == actionSuspend {
+      author, ok := tx.User(chirp.Author_ID)
+      if ok && roleRanks[author.Role] >= roleRanks[moderator.Role] {
+        return errSuspendNotBelow
+      }
+    }
+
+    id, err := tx.NextID("moderation_actions")
+    if err != nil {
+      return err
+    }
+    t := now()
+    reports := tx.OpenReports(chirpId)
+    record = ModerationAction{
+      ID: id,
+      ChirpID: chirpId,
+      AuthorID: chirp.Author_ID,
+      ModeratorID: moderator.ID,
+      Action: action,
+      Note: note,
+      Reports: len(reports),
+      Flags: chirp.ModerationFlags,
+      CreatedAt: t,
+    }
+    if record.Flags == nil {
+      record.Flags = []string{}
+    }
+    err = tx.PutModerationAction(record)
+    if err != nil {
+      return err
+    }
+
+    for _, report := range reports {
+      report.ResolvedAt = &t
+      report.ActionID = id
+      err := tx.PutReport(report)
+      if err != nil {
+        return err
+      }
+    }
+
+    if action == actionSuspend {
+      author, ok := tx.User(chirp.Author_ID)
+      // a ban, unless the author is already serving a suspension
+      if ok && !author.suspended(t) {
+        author.suspend(t, nil, note, false)
+        err := tx.PutUser(author)
+        if err != nil {
+          return err
+        }
+      }
+    }
+    if (action == actionHide || action == actionSuspend) && chirp.HiddenAt == nil {
+      chirp.HiddenAt = &t
+    }
+    chirp.ModerationFlags = nil
+    return tx.PutChirp(chirp)
+  })
+  if err != nil {
+    return ModerationAction{}, err
+  }
+
+  return record, nil
+}
+
+// handlerModerationQueue serves GET /admin/moderation, the chirps that have
+// waited longest first
+func (cfg *apiConfig) handlerModerationQueue(w http.ResponseWriter, r *http.Request) {
+  items, err := cfg.DB.GetModerationQueue()
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve the moderation queue")
+    return
+  }
+
+  params, err := parsePageParams(r, "queued_at")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(item moderationQueueItem) pageCursor {
+    return pageCursor{Sort: "queued_at", Time: item.QueuedAt, ID: item.Chirp.ID}
+  }
+  sortBy(items, keyOf, timeAscending)
+  page, next := paginate(items, params, keyOf, timeAscending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
+
+// handlerModerationActions serves GET /admin/moderation/actions, the most recent first
+func (cfg *apiConfig) handlerModerationActions(w http.ResponseWriter, r *http.Request) {
+  actions, err := cfg.DB.GetModerationActions()
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve moderation actions")
+    return
+  }
+
+  params, err := parsePageParams(r, "desc")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(a ModerationAction) pageCursor {
+    return pageCursor{Sort: "desc", ID: a.ID}
+  }
+  sortBy(actions, keyOf, idDescending)
+  page, next := paginate(actions, params, keyOf, idDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
+
+// handlerModerationAct serves POST /admin/moderation/{id} with
+// {"action": "hide" | "dismiss" | "suspend", "note": "..."} for chirp {id}
+func (cfg *apiConfig) handlerModerationAct(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Action string `json:"action"`
+    Note   string `json:"note"`
+  }
+
+  moderator, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+  if params.Action != actionHide && params.Action != actionDismiss && params.Action != actionSuspend {
+    respondWithError(w, http.StatusBadRequest, "action must be hide, dismiss or suspend")
+    return
+  }
+
+  action, err := cfg.DB.ModerateChirp(id, moderator, params.Action, params.Note)
+  if errors.Is(err, errSuspendNotBelow) {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, action)
+}
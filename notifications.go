@@ -0,0 +1,206 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+const notificationMention = "mention"
+
+type Notification struct {
+  ID        int        `json:"id"`
+  UserID    int        `json:"user_id"`
+  Type      string     `json:"type"`
+  ChirpID   int        `json:"chirp_id,omitempty"`
+  ActorID   int        `json:"actor_id"`
+  CreatedAt time.Time  `json:"created_at"`
+  ReadAt    *time.Time `json:"read_at"`
+}
+
+func (tx *Tx) Notification(id int) (Notification, bool) {
+  notification, ok := tx.db.data.Notifications[id]
+  return notification, ok
+}
+
+// NotificationsForUser returns the inbox of one user, in no particular order
+func (tx *Tx) NotificationsForUser(userId int) []Notification {
+  ids := tx.db.idx.notificationsByUser[userId]
+  notifications := make([]Notification, 0, len(ids))
+  for id := range ids {
+    notifications = append(notifications, tx.db.data.Notifications[id])
+  }
+  return notifications
+}
+
+func (tx *Tx) UnreadNotificationCount(userId int) int {
+  return tx.db.idx.unreadByUser[userId]
+}
+
+func (tx *Tx) PutNotification(notification Notification) error {
+  return tx.write(putRecord("notifications", notification.ID, notification))
+}
+
+func (tx *Tx) DeleteNotification(id int) error {
+  return tx.write(deleteRecord("notifications", id))
+}
+
+// notify drops a notification in the inbox of userId, about chirpId unless
+// it is 0; nobody is notified about their own actions
+func (tx *Tx) notify(userId int, kind string, chirpId int, actorId int) error {
+  if userId == actorId {
+    return nil
+  }
+  id, err := tx.NextID("notifications")
+  if err != nil {
+    return err
+  }
+  return tx.PutNotification(Notification{
+    ID: id,
+    UserID: userId,
+    Type: kind,
+    ChirpID: chirpId,
+    ActorID: actorId,
+    CreatedAt: now(),
+  })
+}
+
+func (db *DB) GetNotifications(userId int) ([]Notification, error) {
+  notifications := []Notification{}
+  err := db.View(func(tx *Tx) error {
+    notifications = tx.NotificationsForUser(userId)
+    return nil
+  })
+  return notifications, err
+}
+
+func (db *DB) GetUnreadNotificationCount(userId int) (int, error) {
+  count := 0
+  err := db.View(func(tx *Tx) error {
+    count = tx.UnreadNotificationCount(userId)
+    return nil
+  })
+  return count, err
+}
+
+// MarkNotificationsRead marks the given notifications of userId as read,
+// or all of them when ids is empty
+func (db *DB) MarkNotificationsRead(userId int, ids ...int) error {
+  return db.Update(func(tx *Tx) error {
+    notifications := []Notification{}
+    if len(ids) == 0 {
+      notifications = tx.NotificationsForUser(userId)
+    }
+    for _, id := range ids {
+      notification, ok := tx.Notification(id)
+      if !ok || notification.UserID != userId {
+        return errors.New("notification not found")
+      }
+      notifications = append(notifications, notification)
+    }
+
+    t := now()
+    for _, notification := range notifications {
+      if notification.ReadAt != nil {
+        continue
+      }
+      notification.ReadAt = &t
+      err := tx.PutNotification(notification)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+func notificationSortKey(n Notification) pageCursor {
+  return pageCursor{Sort: "desc", ID: n.ID}
+}
+
+// handlerNotificationsRetrieve serves GET /api/notifications, newest first;
+// ?unread=true leaves out what was already read
+func (cfg *apiConfig) handlerNotificationsRetrieve(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+  params, err := parsePageParams(r, "desc")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  dbNotifications, err := cfg.DB.GetNotifications(user.ID)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve notifications")
+    return
+  }
+
+  unreadOnly := r.URL.Query().Get("unread") == "true"
+  notifications := []Notification{}
+  for _, notification := range dbNotifications {
+    if unreadOnly && notification.ReadAt != nil {
+      continue
+    }
+    notifications = append(notifications, notification)
+  }
+
+  sortBy(notifications, notificationSortKey, idDescending)
+  page, next := paginate(notifications, params, notificationSortKey, idDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
+
+func (cfg *apiConfig) handlerNotificationsUnreadCount(w http.ResponseWriter, r *http.Request) {
+  type response struct {
+    UnreadCount int `json:"unread_count"`
+  }
+
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  count, err := cfg.DB.GetUnreadNotificationCount(user.ID)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not count notifications")
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, response{
+    UnreadCount: count,
+  })
+}
+
+// handlerNotificationsMarkRead serves POST /api/notifications/{id}/read
+// and, without an id, POST /api/notifications/read for the whole inbox
+func (cfg *apiConfig) handlerNotificationsMarkRead(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  ids := []int{}
+  if idString := r.PathValue("id"); idString != "" {
+    id, err := strconv.Atoi(idString)
+    if err != nil {
+      respondWithError(w, http.StatusBadRequest, "Couldn't parse notification id")
+      return
+    }
+    ids = append(ids, id)
+  }
+
+  err = cfg.DB.MarkNotificationsRead(user.ID, ids...)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
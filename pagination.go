@@ -0,0 +1,140 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "time"
+)
+
+const defaultPageLimit = 20
+const maxPageLimit = 100
+
+// pageCursor marks where a page ended: the sort key of its last item.
+// the next page starts right after that key rather than at an offset, so
+// inserts and deletes in between never make a client skip or repeat items
+type pageCursor struct {
+  Sort string    `json:"s"`
+  Time time.Time `json:"t,omitempty"`
+  ID   int       `json:"id"`
+}
+
+func encodeCursor(c pageCursor) string {
+  dat, _ := json.Marshal(c)
+  return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+  c := pageCursor{}
+  dat, err := base64.RawURLEncoding.DecodeString(s)
+  if err == nil {
+    err = json.Unmarshal(dat, &c)
+  }
+  if err != nil {
+    return c, errors.New("invalid cursor")
+  }
+  return c, nil
+}
+
+// pageParams is what the client asked for; limit 0 means no pagination at all,
+// which keeps the old return-everything behaviour for clients that don't page
+type pageParams struct {
+  limit int
+  after *pageCursor
+}
+
+// parsePageParams reads ?limit= and ?cursor=; a cursor is only valid for the sort order it was made for
+func parsePageParams(r *http.Request, sortOrder string) (pageParams, error) {
+  params := pageParams{}
+  limitString := r.URL.Query().Get("limit")
+  cursorString := r.URL.Query().Get("cursor")
+
+  if limitString != "" {
+    limit, err := strconv.Atoi(limitString)
+    if err != nil || limit < 1 {
+      return params, errors.New("limit must be a positive number")
+    }
+    params.limit = min(limit, maxPageLimit)
+  }
+  if cursorString != "" {
+    c, err := decodeCursor(cursorString)
+    if err != nil {
+      return params, err
+    }
+    if c.Sort != sortOrder {
+      return params, fmt.Errorf("cursor was made for sort=%s", c.Sort)
+    }
+    params.after = &c
+    if params.limit == 0 {
+      params.limit = defaultPageLimit
+    }
+  }
+  return params, nil
+}
+
+// the orders pages come in, comparing sort keys
+func idAscending(a, b pageCursor) bool { return a.ID < b.ID }
+func idDescending(a, b pageCursor) bool { return a.ID > b.ID }
+
+func timeAscending(a, b pageCursor) bool {
+  if a.Time.Equal(b.Time) {
+    return a.ID < b.ID
+  }
+  return a.Time.Before(b.Time)
+}
+
+func timeDescending(a, b pageCursor) bool {
+  if a.Time.Equal(b.Time) {
+    return a.ID > b.ID
+  }
+  return a.Time.After(b.Time)
+}
+
+// sortBy sorts items by their keys, in the order of less
+func sortBy[T any](items []T, keyOf func(T) pageCursor, less func(a, b pageCursor) bool) {
+  sort.Slice(items, func(i, j int) bool {
+    return less(keyOf(items[i]), keyOf(items[j]))
+  })
+}
+
+// paginate cuts one page out of items, which must already be sorted by less.
+// it returns the page and the cursor of the next one, nil on the last page
+func paginate[T any](items []T, params pageParams, keyOf func(T) pageCursor, less func(a, b pageCursor) bool) ([]T, *pageCursor) {
+  if params.limit == 0 {
+    return items, nil
+  }
+
+  start := 0
+  if params.after != nil {
+    after := *params.after
+    start = sort.Search(len(items), func(i int) bool {
+      return less(after, keyOf(items[i]))
+    })
+  }
+  end := min(start+params.limit, len(items))
+
+  page := items[start:end]
+  if end == len(items) || len(page) == 0 {
+    return page, nil
+  }
+  next := keyOf(page[len(page)-1])
+  return page, &next
+}
+
+// setNextLink advertises the next page as `Link: <url>; rel="next"`,
+// the same request with the cursor moved forward
+func setNextLink(w http.ResponseWriter, r *http.Request, params pageParams, next *pageCursor) {
+  if next == nil {
+    return
+  }
+  u := *r.URL
+  q := u.Query()
+  q.Set("cursor", encodeCursor(*next))
+  q.Set("limit", strconv.Itoa(params.limit))
+  u.RawQuery = q.Encode()
+  w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+}
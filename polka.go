@@ -6,9 +6,14 @@ import (
   "encoding/json"
   "strings"
   "errors"
+  "time"
 )
 
-func (cfg *apiConfig) handlerUserUpgradeToRed(w http.ResponseWriter, r *http.Request) {
+// handlerPolkaWebhooks serves POST /api/polka/webhooks; Polka tells us there
+// when a subscription starts, renews or ends, other events are ignored.
+// Polka retries an event until it gets a 200, so events are told apart by
+// their id and one that was applied already is acknowledged and skipped
+func (cfg *apiConfig) handlerPolkaWebhooks(w http.ResponseWriter, r *http.Request) {
   apiKey, errK := getAPIKey(r.Header)
   if errK != nil {
     respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
@@ -25,9 +30,12 @@ func (cfg *apiConfig) handlerUserUpgradeToRed(w http.ResponseWriter, r *http.Req
   
   type parameterData struct {
     User_Id int `json:"user_id"`
+    // when the paid period ends; left out means subscriptionPeriod from now
+    ExpiresAt *time.Time `json:"expires_at"`
   }
 
   type parameters struct {
+    ID string `json:"id"`
     Event string `json:"event"`
     Data parameterData `json:"data"`
   }
@@ -35,7 +43,7 @@ func (cfg *apiConfig) handlerUserUpgradeToRed(w http.ResponseWriter, r *http.Req
   decoder := json.NewDecoder(r.Body)
   params := parameters{}
   err := decoder.Decode(&params)
-  if params.Event != "user.upgraded" {
+  if params.Event != polkaUserUpgraded && params.Event != polkaUserRenewed && params.Event != polkaUserDowngraded {
     respondWithJSON(w, http.StatusOK, "")
     return 
   }
@@ -44,9 +52,9 @@ func (cfg *apiConfig) handlerUserUpgradeToRed(w http.ResponseWriter, r *http.Req
     return
   }
 
-  ok := cfg.DB.UpgradeUserToRed(params.Data.User_Id)
+  _, ok := cfg.DB.ApplySubscriptionEvent(params.Data.User_Id, params.Event, params.ID, params.Data.ExpiresAt)
   if ok != nil {
-    respondWithError(w, http.StatusInternalServerError, ok.Error())
+    respondWithError(w, http.StatusNotFound, ok.Error())
     return
   }
 
@@ -0,0 +1,201 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// the ways a user can react to a chirp; each is at most once per user and chirp
+const (
+  reactionLike    = "like"
+  reactionRechirp = "rechirp"
+)
+
+type Reaction struct {
+  Kind      string    `json:"kind"`
+  ChirpID   int       `json:"chirp_id"`
+  UserID    int       `json:"user_id"`
+  CreatedAt time.Time `json:"created_at"`
+}
+
+// reactionKey is the key of a reaction, so reacting twice finds the first one
+func reactionKey(kind string, chirpId, userId int) string {
+  return fmt.Sprintf("%s:%d:%d", kind, chirpId, userId)
+}
+
+func (r Reaction) key() string {
+  return reactionKey(r.Kind, r.ChirpID, r.UserID)
+}
+
+func (tx *Tx) Reaction(kind string, chirpId, userId int) (Reaction, bool) {
+  reaction, ok := tx.db.data.Reactions[reactionKey(kind, chirpId, userId)]
+  return reaction, ok
+}
+
+// ReactionsByUser returns every reaction of one kind a user made, in no particular order
+func (tx *Tx) ReactionsByUser(kind string, userId int) []Reaction {
+  keys := tx.db.idx.reactionsByUser[userId]
+  reactions := make([]Reaction, 0, len(keys))
+  for key := range keys {
+    if reaction := tx.db.data.Reactions[key]; reaction.Kind == kind {
+      reactions = append(reactions, reaction)
+    }
+  }
+  return reactions
+}
+
+func (tx *Tx) PutReaction(reaction Reaction) error {
+  return tx.write(putNamedRecord("reactions", reaction.key(), reaction))
+}
+
+func (tx *Tx) DeleteReaction(reaction Reaction) error {
+  return tx.write(putNamedRecord("reactions", reaction.key(), nil))
+}
+
+// deleteReactions drops every reaction to a chirp that is going away
+func (tx *Tx) deleteReactions(chirpId int) error {
+  for key := range tx.db.idx.reactionsByChirp[chirpId] {
+    err := tx.DeleteReaction(tx.db.data.Reactions[key])
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// countReaction keeps the counters on the chirp in step with its reactions
+func countReaction(chirp *Chirp, kind string, delta int) {
+  switch kind {
+  case reactionLike:
+    chirp.LikeCount += delta
+  case reactionRechirp:
+    chirp.RechirpCount += delta
+  }
+}
+
+// React adds (on == true) or takes back a reaction of user to a chirp and
+// returns the chirp with its new counts; doing either twice changes nothing
+func (db *DB) React(kind string, chirpId int, user User, on bool) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    chirp, ok = tx.Chirp(chirpId)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+
+    _, exists := tx.Reaction(kind, chirpId, user.ID)
+    if exists == on {
+      return nil
+    }
+    reaction := Reaction{Kind: kind, ChirpID: chirpId, UserID: user.ID, CreatedAt: now()}
+    if !on {
+      countReaction(&chirp, kind, -1)
+      err := tx.DeleteReaction(reaction)
+      if err != nil {
+        return err
+      }
+      return tx.PutChirp(chirp)
+    }
+
+    countReaction(&chirp, kind, 1)
+    err := tx.PutReaction(reaction)
+    if err != nil {
+      return err
+    }
+    err = tx.PutChirp(chirp)
+    if err != nil {
+      return err
+    }
+    return tx.notify(chirp.Author_ID, kind, chirp.ID, user.ID)
+  })
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  return chirp, nil
+}
+
+// likedChirp is a chirp as it shows up in someone's likes
+type likedChirp struct {
+  Chirp
+  LikedAt time.Time `json:"liked_at"`
+}
+
+// GetLikedChirps returns the chirps a user liked that are still around
+func (db *DB) GetLikedChirps(userId int) ([]likedChirp, error) {
+  liked := []likedChirp{}
+  err := db.View(func(tx *Tx) error {
+    for _, like := range tx.ReactionsByUser(reactionLike, userId) {
+      chirp, ok := tx.Chirp(like.ChirpID)
+      if ok && !chirp.hidden() {
+        liked = append(liked, likedChirp{Chirp: chirp, LikedAt: like.CreatedAt})
+      }
+    }
+    return nil
+  })
+  return liked, err
+}
+
+func (cfg *apiConfig) handlerChirpsLike(w http.ResponseWriter, r *http.Request) {
+  cfg.handleReaction(w, r, reactionLike)
+}
+
+func (cfg *apiConfig) handlerChirpsRechirp(w http.ResponseWriter, r *http.Request) {
+  cfg.handleReaction(w, r, reactionRechirp)
+}
+
+// handleReaction serves POST (react) and DELETE (take it back) on /api/chirps/{id}/<kind>
+func (cfg *apiConfig) handleReaction(w http.ResponseWriter, r *http.Request, kind string) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  chirp, err := cfg.DB.React(kind, id, user, r.Method == http.MethodPost)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// handlerUserLikes serves GET /api/users/{id}/likes, most recently liked first
+func (cfg *apiConfig) handlerUserLikes(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the GET request")
+    return
+  }
+
+  liked, err := cfg.DB.GetLikedChirps(id)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve likes")
+    return
+  }
+
+  params, err := parsePageParams(r, "-liked_at")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(c likedChirp) pageCursor {
+    return pageCursor{Sort: "-liked_at", Time: c.LikedAt, ID: c.ID}
+  }
+  sortBy(liked, keyOf, timeDescending)
+  page, next := paginate(liked, params, keyOf, timeDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
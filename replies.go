@@ -0,0 +1,173 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "strconv"
+)
+
+const notificationReply = "reply"
+
+var errParentNotFound = errors.New("the chirp you are replying to does not exist")
+
+// Replies returns the direct replies to a chirp, in no particular order
+func (tx *Tx) Replies(id int) []Chirp {
+  ids := tx.db.idx.repliesByParent[id]
+  replies := make([]Chirp, 0, len(ids))
+  for replyId := range ids {
+    replies = append(replies, tx.db.data.Chirps[replyId])
+  }
+  return replies
+}
+
+// Ancestors returns the chain of parents of chirp, the root of the thread
+// first; it stops below a parent that is not in threads, see inThread
+func (tx *Tx) Ancestors(chirp Chirp) []Chirp {
+  ancestors := []Chirp{}
+  for chirp.InReplyTo != 0 {
+    parent, ok := tx.Chirp(chirp.InReplyTo)
+    if !ok || !parent.inThread() {
+      break
+    }
+    ancestors = append([]Chirp{parent}, ancestors...)
+    chirp = parent
+  }
+  return ancestors
+}
+
+// Descendants returns every reply below chirp, however deep, in no particular
+// order; replies that are not in threads are left out along with their own
+func (tx *Tx) Descendants(id int) []Chirp {
+  descendants := []Chirp{}
+  queue := []int{id}
+  for len(queue) > 0 {
+    replies := tx.Replies(queue[0])
+    queue = queue[1:]
+    for _, reply := range replies {
+      if !reply.inThread() {
+        continue
+      }
+      descendants = append(descendants, reply)
+      queue = append(queue, reply.ID)
+    }
+  }
+  return descendants
+}
+
+// addReply counts a new reply on its parent; replies to deleted chirps are refused
+func (tx *Tx) addReply(reply Chirp) (Chirp, error) {
+  parent, ok := tx.Chirp(reply.InReplyTo)
+  if !ok || parent.hidden() {
+    return Chirp{}, errParentNotFound
+  }
+  parent.ReplyCount++
+  return parent, tx.PutChirp(parent)
+}
+
+// removeChirp deletes a chirp without tearing its thread apart: a chirp
+// that still has replies is kept as a tombstone without body, tags or
+// mentions, and a tombstone goes away with its last reply
+func (tx *Tx) removeChirp(chirp Chirp) error {
+  err := errors.Join(tx.deleteReactions(chirp.ID), tx.deleteRevisions(chirp.ID), tx.deleteReports(chirp.ID))
+  if err != nil {
+    return err
+  }
+  chirp.LikeCount, chirp.RechirpCount = 0, 0
+
+  if chirp.ReplyCount > 0 {
+    chirp.Body = ""
+    chirp.Tags = []string{}
+    chirp.Mentions = []Mention{}
+    chirp.Deleted = true
+    chirp.UpdatedAt = now()
+    return tx.PutChirp(chirp)
+  }
+
+  err = tx.DeleteChirp(chirp.ID)
+  if err != nil || !chirp.countsAsReply() {
+    return err
+  }
+  return tx.countReply(chirp, -1)
+}
+
+// countsAsReply reports whether a chirp is in its parent's reply_count:
+// replies count while they are published and not in the trash
+func (c Chirp) countsAsReply() bool {
+  return c.InReplyTo != 0 && !c.unpublished() && c.DeletedAt == nil
+}
+
+// countReply adds delta to the reply_count of the parent of reply, if the
+// parent is still around
+func (tx *Tx) countReply(reply Chirp, delta int) error {
+  parent, ok := tx.Chirp(reply.InReplyTo)
+  if !ok {
+    return nil
+  }
+  parent.ReplyCount += delta
+  if parent.Deleted && parent.ReplyCount == 0 {
+    // the tombstone only stayed around for this reply
+    return tx.removeChirp(parent)
+  }
+  return tx.PutChirp(parent)
+}
+
+type thread struct {
+  Ancestors []Chirp `json:"ancestors"`
+  Chirp     Chirp   `json:"chirp"`
+  Replies   []Chirp `json:"replies"`
+}
+
+// GetThread returns the conversation around a chirp; its replies come
+// unsorted, each one pointing at its parent with in_reply_to
+func (db *DB) GetThread(id int) (thread, error) {
+  t := thread{}
+  err := db.View(func(tx *Tx) error {
+    chirp, ok := tx.Chirp(id)
+    if !ok || !chirp.inThread() {
+      return errors.New("chirp not found")
+    }
+    t = thread{
+      Ancestors: tx.Ancestors(chirp),
+      Chirp: chirp.placeholder(),
+      Replies: tx.Descendants(id),
+    }
+    for i := range t.Ancestors {
+      t.Ancestors[i] = t.Ancestors[i].placeholder()
+    }
+    for i := range t.Replies {
+      t.Replies[i] = t.Replies[i].placeholder()
+    }
+    return nil
+  })
+  return t, err
+}
+
+// handlerChirpThread serves GET /api/chirps/{id}/thread. replies are paged
+// oldest first, so every reply comes after the one it answers and clients
+// can build the tree as the pages arrive
+func (cfg *apiConfig) handlerChirpThread(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the GET request")
+    return
+  }
+
+  t, err := cfg.DB.GetThread(id)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  params, err := parsePageParams(r, "asc")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := chirpSortKey("asc")
+  sortBy(t.Replies, keyOf, chirpSortOrders["asc"])
+  page, next := paginate(t.Replies, params, keyOf, chirpSortOrders["asc"])
+  setNextLink(w, r, params, next)
+  t.Replies = page
+
+  respondWithJSON(w, http.StatusOK, t)
+}
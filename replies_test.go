@@ -0,0 +1,138 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "testing"
+)
+
+func createReply(t *testing.T, db *DB, author User, parent int, body string) Chirp {
+  t.Helper()
+  chirp, err := db.CreateChirp(Chirp{Body: body, InReplyTo: parent}, author)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return chirp
+}
+
+// threadIDs lists a thread as ancestors, the chirp and its sorted replies
+func threadIDs(t *testing.T, db *DB, id int) string {
+  t.Helper()
+  th, err := db.GetThread(id)
+  if err != nil {
+    t.Fatal(err)
+  }
+  replies := chirpIDs(th.Replies)
+  sort.Ints(replies)
+  return fmt.Sprint(chirpIDs(th.Ancestors), th.Chirp.ID, replies)
+}
+
+func TestThreads(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  two := createReply(t, db, bob, root.ID, "two")
+  createReply(t, db, alice, two.ID, "three")
+  createReply(t, db, bob, root.ID, "four")
+
+  if got := threadIDs(t, db, root.ID); got != "[] 1 [2 3 4]" {
+    t.Fatalf("thread of the root = %s", got)
+  }
+  if got := threadIDs(t, db, 3); got != "[1 2] 3 []" {
+    t.Fatalf("thread of 3 = %s", got)
+  }
+  if root, _ := db.GetChirp(root.ID); root.ReplyCount != 2 {
+    t.Fatalf("root has %d replies, want 2", root.ReplyCount)
+  }
+  if _, err := db.CreateChirp(Chirp{Body: "to nothing", InReplyTo: 99}, bob); err != errParentNotFound {
+    t.Fatalf("replying to a missing chirp = %v", err)
+  }
+}
+
+func TestDeletedChirpsWithRepliesLeaveTombstones(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  two := createReply(t, db, bob, root.ID, "two #tag")
+  three := createReply(t, db, alice, two.ID, "three")
+
+  err = db.DeleteChrip(two)
+  if err != nil {
+    t.Fatal(err)
+  }
+  th, err := db.GetThread(three.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(th.Ancestors) != 2 {
+    t.Fatalf("ancestors of 3 = %v", chirpIDs(th.Ancestors))
+  }
+  // where it was, not what it said
+  tombstone := th.Ancestors[1]
+  if tombstone.ID != two.ID || !tombstone.Deleted || tombstone.Body != "" || len(tombstone.Tags) != 0 {
+    t.Fatalf("tombstone = %+v", tombstone)
+  }
+  if _, err := db.GetChirp(two.ID); err == nil {
+    t.Fatal("the tombstone is served as a chirp")
+  }
+  if _, err := db.CreateChirp(Chirp{Body: "late", InReplyTo: two.ID}, alice); err != errParentNotFound {
+    t.Fatalf("replying to a tombstone = %v", err)
+  }
+
+  // the tombstone goes away with its last reply
+  err = db.DeleteChrip(three)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := threadIDs(t, db, root.ID); got != "[] 1 []" {
+    t.Fatalf("thread after deleting the last reply = %s", got)
+  }
+  if _, err := db.GetThread(two.ID); err == nil {
+    t.Fatal("the tombstone outlived its last reply")
+  }
+  if root, _ := db.GetChirp(root.ID); root.ReplyCount != 0 {
+    t.Fatalf("root has %d replies, want 0", root.ReplyCount)
+  }
+}
+
+func TestThreadsLeaveOutDraftsAndTrash(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  draft, err := db.CreateChirp(Chirp{Body: "not yet", InReplyTo: root.ID, Status: chirpDraft}, bob)
+  if err != nil {
+    t.Fatal(err)
+  }
+  trashed := createReply(t, db, bob, root.ID, "second thoughts")
+  below := createReply(t, db, alice, trashed.ID, "below the trash")
+  createReply(t, db, alice, root.ID, "stays")
+  _, err = db.TrashChirp(trashed.ID, bob)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if got := threadIDs(t, db, root.ID); got != "[] 1 [5]" {
+    t.Fatalf("thread of the root = %s", got)
+  }
+  for _, id := range []int{draft.ID, trashed.ID} {
+    if _, err := db.GetThread(id); err == nil {
+      t.Fatalf("thread of %d was found", id)
+    }
+  }
+  // as if the trashed parent was not there
+  if got := threadIDs(t, db, below.ID); got != "[] 4 []" {
+    t.Fatalf("thread below the trash = %s", got)
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const maxReportReasonLength = 500
+
+var errAlreadyReported = errors.New("You already reported this chirp")
+
+// Report is a user telling the moderators something is wrong with a chirp
+type Report struct {
+  ID         int        `json:"id"`
+  ChirpID    int        `json:"chirp_id"`
+  ReporterID int        `json:"reporter_id"`
+  Reason     string     `json:"reason"`
+  CreatedAt  time.Time  `json:"created_at"`
+  // set once a moderator acted on the chirp, see ModerationAction
+  ResolvedAt *time.Time `json:"resolved_at"`
+  ActionID   int        `json:"action_id,omitempty"`
+}
+
+// openReportKey finds the open report of one user on one chirp
+func openReportKey(chirpId, reporterId int) string {
+  return fmt.Sprintf("%d:%d", chirpId, reporterId)
+}
+
+// OpenReports returns the reports on a chirp no moderator looked at yet, in no particular order
+func (tx *Tx) OpenReports(chirpId int) []Report {
+  ids := tx.db.idx.openReportsByChirp[chirpId]
+  reports := make([]Report, 0, len(ids))
+  for id := range ids {
+    reports = append(reports, tx.db.data.Reports[id])
+  }
+  return reports
+}
+
+func (tx *Tx) PutReport(report Report) error {
+  return tx.write(putRecord("reports", report.ID, report))
+}
+
+func (tx *Tx) DeleteReport(id int) error {
+  return tx.write(deleteRecord("reports", id))
+}
+
+// deleteReports drops every report on a chirp that is going away; what the
+// moderators did about it stays in the moderation actions
+func (tx *Tx) deleteReports(chirpId int) error {
+  for id := range tx.db.idx.reportsByChirp[chirpId] {
+    err := tx.DeleteReport(id)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// ReportChirp files a report by reporter; one open report per user and chirp
+func (db *DB) ReportChirp(chirpId int, reporter User, reason string) (Report, error) {
+  report := Report{}
+  err := db.Update(func(tx *Tx) error {
+    chirp, ok := tx.Chirp(chirpId)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    if _, ok := tx.db.idx.openReportByReporter[openReportKey(chirpId, reporter.ID)]; ok {
+      return errAlreadyReported
+    }
+
+    id, err := tx.NextID("reports")
+    if err != nil {
+      return err
+    }
+    report = Report{
+      ID: id,
+      ChirpID: chirpId,
+      ReporterID: reporter.ID,
+      Reason: reason,
+      CreatedAt: now(),
+    }
+    return tx.PutReport(report)
+  })
+  if err != nil {
+    return Report{}, err
+  }
+
+  return report, nil
+}
+
+// handlerChirpsReport serves POST /api/chirps/{id}/report
+func (cfg *apiConfig) handlerChirpsReport(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Reason string `json:"reason"`
+  }
+
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+  reason := strings.TrimSpace(params.Reason)
+  if reason == "" || len(reason) > maxReportReasonLength {
+    respondWithError(w, http.StatusBadRequest, "A report needs a reason of at most 500 characters")
+    return
+  }
+
+  report, err := cfg.DB.ReportChirp(id, user, reason)
+  if errors.Is(err, errAlreadyReported) {
+    respondWithError(w, http.StatusConflict, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusCreated, report)
+}
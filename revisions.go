@@ -0,0 +1,213 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+var errNotChirpAuthor = errors.New("This chirp does not belong to you")
+
+// Revision is what a chirp said before one of its edits
+type Revision struct {
+  ID         int       `json:"id"`
+  ChirpID    int       `json:"chirp_id"`
+  Body       string    `json:"body"`
+  Tags       []string  `json:"tags"`
+  // when this text was posted, and when an edit replaced it
+  CreatedAt  time.Time `json:"created_at"`
+  ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// Revisions returns the earlier versions of a chirp, in no particular order
+func (tx *Tx) Revisions(chirpId int) []Revision {
+  ids := tx.db.idx.revisionsByChirp[chirpId]
+  revisions := make([]Revision, 0, len(ids))
+  for id := range ids {
+    revisions = append(revisions, tx.db.data.Revisions[id])
+  }
+  return revisions
+}
+
+func (tx *Tx) PutRevision(revision Revision) error {
+  return tx.write(putRecord("revisions", revision.ID, revision))
+}
+
+func (tx *Tx) DeleteRevision(id int) error {
+  return tx.write(deleteRecord("revisions", id))
+}
+
+// deleteRevisions drops the history of a chirp that is going away
+func (tx *Tx) deleteRevisions(chirpId int) error {
+  for id := range tx.db.idx.revisionsByChirp[chirpId] {
+    err := tx.DeleteRevision(id)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// EditChirp replaces the body of a chirp of user with the moderated one,
+// keeping the old one as a revision. tags and mentions follow the new body; only users it mentions
+// for the first time are notified
+func (db *DB) EditChirp(id int, user User, moderation Moderation) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    chirp, ok = tx.Chirp(id)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    if chirp.Author_ID != user.ID {
+      return errNotChirpAuthor
+    }
+
+    revisionId, err := tx.NextID("revisions")
+    if err != nil {
+      return err
+    }
+    t := now()
+    postedAt := chirp.CreatedAt
+    if chirp.EditedAt != nil {
+      postedAt = *chirp.EditedAt
+    }
+    err = tx.PutRevision(Revision{
+      ID: revisionId,
+      ChirpID: chirp.ID,
+      Body: chirp.Body,
+      Tags: chirp.Tags,
+      CreatedAt: postedAt,
+      ReplacedAt: t,
+    })
+    if err != nil {
+      return err
+    }
+
+    mentioned := map[int]bool{}
+    for _, mention := range chirp.Mentions {
+      mentioned[mention.UserID] = true
+    }
+    chirp.Body = moderation.Body
+    chirp.Tags = extractHashtags(chirp.Body)
+    chirp.Mentions = tx.ResolveMentions(chirp.Body)
+    chirp.ModerationFlags = moderation.Flags
+    chirp.EditedAt = &t
+    chirp.UpdatedAt = t
+    err = tx.PutChirp(chirp)
+    if err != nil {
+      return err
+    }
+
+    for _, mention := range chirp.Mentions {
+      if mentioned[mention.UserID] {
+        continue
+      }
+      mentioned[mention.UserID] = true
+      err := tx.notify(mention.UserID, notificationMention, chirp.ID, user.ID)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  return chirp, nil
+}
+
+func (db *DB) GetRevisions(chirpId int) ([]Revision, error) {
+  revisions := []Revision{}
+  err := db.View(func(tx *Tx) error {
+    chirp, ok := tx.Chirp(chirpId)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    revisions = tx.Revisions(chirpId)
+    return nil
+  })
+  return revisions, err
+}
+
+// handlerChirpsUpdate serves PUT /api/chirps/{id}; editing is a Chirpy Red perk
+func (cfg *apiConfig) handlerChirpsUpdate(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Body string `json:"body"`
+  }
+
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+  err = requireEntitlement(user, featureEditChirps)
+  if err != nil {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the PUT request")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+
+  moderation, err := cfg.validateChirp(params.Body, user)
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  chirp, err := cfg.DB.EditChirp(id, user, moderation)
+  if errors.Is(err, errNotChirpAuthor) {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// handlerChirpRevisions serves GET /api/chirps/{id}/revisions, oldest first
+func (cfg *apiConfig) handlerChirpRevisions(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the GET request")
+    return
+  }
+
+  revisions, err := cfg.DB.GetRevisions(id)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  params, err := parsePageParams(r, "asc")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(rev Revision) pageCursor {
+    return pageCursor{Sort: "asc", ID: rev.ID}
+  }
+  sortBy(revisions, keyOf, idAscending)
+  page, next := paginate(revisions, params, keyOf, idAscending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
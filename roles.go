@@ -0,0 +1,112 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strconv"
+)
+
+// what a user may do; every role can do everything the ones before it can
+const (
+  roleUser      = "user"
+  roleModerator = "moderator"
+  roleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+  roleUser:      1,
+  roleModerator: 2,
+  roleAdmin:     3,
+}
+
+var errInvalidRole = errors.New("role must be user, moderator or admin")
+
+func validRole(role string) bool {
+  _, ok := roleRanks[role]
+  return ok
+}
+
+// roleAllows reports whether role may do what required is needed for
+func roleAllows(role, required string) bool {
+  return validRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// SetUserRole gives a user a new role. their access token carries the old
+// one, so it stops working and they need to refresh it
+func (db *DB) SetUserRole(userId int, role string) (User, error) {
+  if !validRole(role) {
+    return User{}, errInvalidRole
+  }
+  return db.updateUser(userId, func(user *User) error {
+    if user.Role != role {
+      user.Role = role
+      user.AccessToken = ""
+      user.UpdatedAt = now()
+    }
+    return nil
+  })
+}
+
+// middlewareRequireRole lets a request through only with a valid access
+// token whose role is at least role
+func (cfg *apiConfig) middlewareRequireRole(role string, next http.HandlerFunc) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    _, claims, err := cfg.authenticatedUserClaims(r)
+    if err != nil {
+      respondWithError(w, http.StatusUnauthorized, err.Error())
+      return
+    }
+    // this is the user's current token, SetUserRole retires the old one,
+    // so its role is the one they have now
+    if !roleAllows(claims.Role, role) {
+      respondWithError(w, http.StatusForbidden, "You are not allowed to do this")
+      return
+    }
+    next(w, r)
+  })
+}
+
+// handlerUsersSetRole serves PUT /admin/users/{id}/role with {"role": "user" | "moderator" | "admin"}
+func (cfg *apiConfig) handlerUsersSetRole(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Role string `json:"role"`
+  }
+
+  admin, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+  // so the last admin can't lock everybody out
+  if id == admin.ID {
+    respondWithError(w, http.StatusBadRequest, "You cannot change your own role")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+  if !validRole(params.Role) {
+    respondWithError(w, http.StatusBadRequest, errInvalidRole.Error())
+    return
+  }
+
+  user, err := cfg.DB.SetUserRole(id, params.Role)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, newUserResponse(user))
+}
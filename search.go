@@ -0,0 +1,260 @@
+package main
+
+import (
+  "math"
+  "sort"
+  "slices"
+  "strings"
+  "unicode"
+
+  "golang.org/x/text/cases"
+)
+
+// bm25 tuning; the usual defaults work fine for text as short as a chirp
+const bm25K1 = 1.2
+const bm25B = 0.75
+
+// foldCase lowercases text the Unicode way ("Straße" and "STRASSE" fold
+// the same). a Caser keeps state, so every call gets its own
+func foldCase(text string) string {
+  return cases.Fold().String(text)
+}
+
+// tokenize splits text into case-folded words; anything that is not a
+// letter or a digit separates words, so "Kerfuffle!" and "kerfuffle" match
+func tokenize(text string) []string {
+  return strings.FieldsFunc(foldCase(text), func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+  })
+}
+
+// searchIndex is a positional inverted index over chirp bodies.
+// it lives with the other indexes, so it is rebuilt on open and kept
+// current by every write whatever storage is underneath
+type searchIndex struct {
+  // term -> chirp id -> positions of the term in the body
+  postings map[string]map[int][]int
+  docLen   map[int]int
+  totalLen int
+  // every term, sorted, for prefix queries. only add and remove change it,
+  // under the database write lock, so searches can share it freely
+  terms []string
+}
+
+func newSearchIndex() *searchIndex {
+  return &searchIndex{
+    postings: map[string]map[int][]int{},
+    docLen: map[int]int{},
+  }
+}
+
+func (si *searchIndex) add(chirp Chirp) {
+  tokens := tokenize(chirp.Body)
+  for pos, term := range tokens {
+    docs, ok := si.postings[term]
+    if !ok {
+      docs = map[int][]int{}
+      si.postings[term] = docs
+      i, _ := slices.BinarySearch(si.terms, term)
+      si.terms = slices.Insert(si.terms, i, term)
+    }
+    docs[chirp.ID] = append(docs[chirp.ID], pos)
+  }
+  si.docLen[chirp.ID] = len(tokens)
+  si.totalLen += len(tokens)
+}
+
+func (si *searchIndex) remove(chirp Chirp) {
+  for _, term := range tokenize(chirp.Body) {
+    docs := si.postings[term]
+    delete(docs, chirp.ID)
+    if len(docs) == 0 {
+      delete(si.postings, term)
+      if i, found := slices.BinarySearch(si.terms, term); found {
+        si.terms = slices.Delete(si.terms, i, i+1)
+      }
+    }
+  }
+  si.totalLen -= si.docLen[chirp.ID]
+  delete(si.docLen, chirp.ID)
+}
+
+// expandPrefix returns every indexed term starting with prefix
+func (si *searchIndex) expandPrefix(prefix string) []string {
+  start := sort.SearchStrings(si.terms, prefix)
+  matches := []string{}
+  for _, term := range si.terms[start:] {
+    if !strings.HasPrefix(term, prefix) {
+      break
+    }
+    matches = append(matches, term)
+  }
+  return matches
+}
+
+// searchClause is one part of a query: a word, a word prefix (`fox*`)
+// or a quoted phrase (`"quick brown fox"`). a chirp must match every clause
+type searchClause struct {
+  terms  []string
+  prefix bool
+}
+
+func parseSearchQuery(q string) []searchClause {
+  clauses := []searchClause{}
+  for len(q) > 0 {
+    q = strings.TrimLeftFunc(q, unicode.IsSpace)
+    if q == "" {
+      break
+    }
+    if q[0] == '"' {
+      phrase, rest, _ := strings.Cut(q[1:], `"`)
+      if terms := tokenize(phrase); len(terms) > 0 {
+        clauses = append(clauses, searchClause{terms: terms})
+      }
+      q = rest
+      continue
+    }
+
+    word, rest, _ := strings.Cut(q, " ")
+    q = rest
+    prefix := strings.HasSuffix(word, "*")
+    for _, term := range tokenize(word) {
+      clauses = append(clauses, searchClause{terms: []string{term}})
+    }
+    // only the last word of something like `e-mail*` is a prefix
+    if prefix && len(clauses) > 0 && len(clauses[len(clauses)-1].terms) == 1 {
+      clauses[len(clauses)-1].prefix = true
+    }
+  }
+  return clauses
+}
+
+// match returns the chirps matching the clause along with how often it
+// matched in each, plus the document frequency per term used for scoring
+func (si *searchIndex) match(clause searchClause) map[int]map[string]int {
+  hits := map[int]map[string]int{}
+
+  if clause.prefix {
+    for _, term := range si.expandPrefix(clause.terms[0]) {
+      for id, positions := range si.postings[term] {
+        if hits[id] == nil {
+          hits[id] = map[string]int{}
+        }
+        hits[id][term] = len(positions)
+      }
+    }
+    return hits
+  }
+
+  first := si.postings[clause.terms[0]]
+  for id, positions := range first {
+    count := 0
+    for _, start := range positions {
+      if si.phraseAt(id, clause.terms, start) {
+        count++
+      }
+    }
+    if count > 0 {
+      hits[id] = map[string]int{}
+      for _, term := range clause.terms {
+        hits[id][term] = count
+      }
+    }
+  }
+  return hits
+}
+
+// phraseAt reports whether terms appear one after another from position start
+func (si *searchIndex) phraseAt(id int, terms []string, start int) bool {
+  for offset, term := range terms[1:] {
+    found := false
+    for _, pos := range si.postings[term][id] {
+      if pos == start+offset+1 {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+type searchHit struct {
+  Chirp
+  Score float64 `json:"score"`
+}
+
+// search returns the chirps matching q, best match first, scored with bm25;
+// only the ids of the hits are filled in
+func (si *searchIndex) search(q string) []searchHit {
+  clauses := parseSearchQuery(q)
+  if len(clauses) == 0 {
+    return []searchHit{}
+  }
+
+  var scores map[int]float64
+  docCount := float64(len(si.docLen))
+  avgLen := 1.0
+  if docCount > 0 {
+    avgLen = math.Max(float64(si.totalLen)/docCount, 1)
+  }
+
+  for _, clause := range clauses {
+    clauseScores := map[int]float64{}
+    for id, termFreqs := range si.match(clause) {
+      if scores != nil {
+        if _, ok := scores[id]; !ok {
+          continue
+        }
+      }
+      score := 0.0
+      for term, tf := range termFreqs {
+        df := float64(len(si.postings[term]))
+        idf := math.Log(1 + (docCount-df+0.5)/(df+0.5))
+        norm := bm25K1 * (1 - bm25B + bm25B*float64(si.docLen[id])/avgLen)
+        score += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+      }
+      // phrases are rarer than their words, reward matching them whole
+      if len(clause.terms) > 1 {
+        score *= float64(len(clause.terms))
+      }
+      clauseScores[id] = score
+      if scores != nil {
+        clauseScores[id] += scores[id]
+      }
+    }
+    scores = clauseScores
+  }
+
+  hits := make([]searchHit, 0, len(scores))
+  for id, score := range scores {
+    hits = append(hits, searchHit{Chirp: Chirp{ID: id}, Score: score})
+  }
+  sort.Slice(hits, func(i, j int) bool {
+    if hits[i].Score == hits[j].Score {
+      return hits[i].ID > hits[j].ID
+    }
+    return hits[i].Score > hits[j].Score
+  })
+  return hits
+}
+
+// SearchChirps returns up to limit chirps matching q, best match first;
+// like the chirp listing it leaves out authors whose suspension hides them
+func (tx *Tx) SearchChirps(q string, limit int) []searchHit {
+  t := now()
+  hits := []searchHit{}
+  for _, hit := range tx.db.idx.search.search(q) {
+    if len(hits) == limit {
+      break
+    }
+    hit.Chirp = tx.db.data.Chirps[hit.ID]
+    if tx.suspensionHides(hit.Author_ID, t) {
+      continue
+    }
+    hits = append(hits, hit)
+  }
+  return hits
+}
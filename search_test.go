@@ -0,0 +1,179 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "testing"
+)
+
+// run with -race: prefix searches share the sorted term list while only
+// holding the read lock, and writers keep changing it
+func TestConcurrentPrefixSearches(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author, "the quick brown fox", "a quiet fox", "quite the brown dog")
+
+  var wg sync.WaitGroup
+  for w := 0; w < 4; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := 0; i < 20; i++ {
+        hits, err := db.SearchChirps("qui*", 10)
+        if err != nil {
+          t.Error(err)
+          return
+        }
+        if len(hits) != 3 {
+          t.Errorf("qui* found %d chirps, want 3", len(hits))
+          return
+        }
+      }
+    }()
+  }
+  // and writers adding terms, so the list keeps going stale
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 20; i++ {
+      if _, err := db.CreateChirp(Chirp{Body: "brand new words"}, author); err != nil {
+        t.Error(err)
+        return
+      }
+    }
+  }()
+  wg.Wait()
+}
+
+func searchIDs(t *testing.T, db *DB, q string) []int {
+  t.Helper()
+  hits, err := db.SearchChirps(q, 10)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ids := []int{}
+  for _, hit := range hits {
+    ids = append(ids, hit.ID)
+  }
+  return ids
+}
+
+func TestSearchRanksWithBM25(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author,
+    "a fox in a long chirp about many other things entirely",
+    "fox fox fox",
+    "a fox",
+    "nothing to see here",
+    "the Fox and the hound",
+  )
+
+  // more occurrences beat fewer, and a short chirp beats a long one
+  if ids := searchIDs(t, db, "fox"); fmt.Sprint(ids) != "[2 3 5 1]" {
+    t.Fatalf("fox = %v", ids)
+  }
+  // every word has to match; the rarer one decides the order
+  if ids := searchIDs(t, db, "FOX hound"); fmt.Sprint(ids) != "[5]" {
+    t.Fatalf("fox hound = %v", ids)
+  }
+  if ids := searchIDs(t, db, "fox badger"); len(ids) != 0 {
+    t.Fatalf("fox badger = %v", ids)
+  }
+  hits, _ := db.SearchChirps("fox", 2)
+  if len(hits) != 2 || hits[0].Score < hits[1].Score || hits[0].Body != "fox fox fox" {
+    t.Fatalf("fox limited to 2 = %+v", hits)
+  }
+}
+
+func TestSearchPhrases(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  createChirps(t, db, author,
+    "the quick brown fox",
+    "brown quick fox",
+    "quick, brown! and a fox",
+    "quick brown quick brown",
+  )
+
+  // punctuation does not break a phrase, other words and the order do
+  if ids := searchIDs(t, db, `"quick brown"`); fmt.Sprint(ids) != "[4 1 3]" {
+    t.Fatalf(`"quick brown" = %v`, ids)
+  }
+  if ids := searchIDs(t, db, `"quick brown fox"`); fmt.Sprint(ids) != "[1]" {
+    t.Fatalf(`"quick brown fox" = %v`, ids)
+  }
+  if ids := searchIDs(t, db, `"brown quick" fox`); fmt.Sprint(ids) != "[2]" {
+    t.Fatalf(`"brown quick" fox = %v`, ids)
+  }
+}
+
+func TestSearchPrefixes(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  chirps := createChirps(t, db, author, "quiet evening", "a quick one", "quinoa salad", "unique")
+
+  if ids := searchIDs(t, db, "qui*"); len(ids) != 3 {
+    t.Fatalf("qui* = %v", ids)
+  }
+  if ids := searchIDs(t, db, "quin*"); fmt.Sprint(ids) != "[3]" {
+    t.Fatalf("quin* = %v", ids)
+  }
+  // a prefix only matches the start of a word
+  if ids := searchIDs(t, db, "ique*"); len(ids) != 0 {
+    t.Fatalf("ique* = %v", ids)
+  }
+
+  // terms come and go with their chirps
+  err = db.DeleteChrip(chirps[2])
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ids := searchIDs(t, db, "quin*"); len(ids) != 0 {
+    t.Fatalf("quin* after deleting = %v", ids)
+  }
+  createChirps(t, db, author, "quince jam")
+  if ids := searchIDs(t, db, "quin*"); fmt.Sprint(ids) != "[5]" {
+    t.Fatalf("quin* after adding = %v", ids)
+  }
+  si := db.idx.search
+  if !sort.StringsAreSorted(si.terms) || len(si.terms) != len(si.postings) {
+    t.Fatalf("terms = %v", si.terms)
+  }
+}
+
+func TestSearchLeavesOutSuspendedAuthors(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  createChirps(t, db, alice, "hello from alice")
+  createChirps(t, db, bob, "hello from bob")
+
+  _, err = db.SuspendUser(bob.ID, 0, "spam", true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ids := searchIDs(t, db, "hello"); fmt.Sprint(ids) != "[1]" {
+    t.Fatalf("hello while bob is suspended = %v", ids)
+  }
+  // the limit counts what is returned, not what was left out
+  if hits, _ := db.SearchChirps("hello", 1); len(hits) != 1 || hits[0].ID != 1 {
+    t.Fatalf("hello limited to 1 = %+v", hits)
+  }
+}
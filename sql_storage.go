@@ -0,0 +1,156 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "path/filepath"
+  "strings"
+
+  _ "modernc.org/sqlite"
+)
+
+// sqlStorage keeps every table in an embedded sqlite database;
+// the driver is pure go so there is no cgo and no server to run.
+// sqlite is only where the records are kept, one row each so a write
+// touches just what changed: DB reads everything once at open and answers
+// every query from its cache and indexes, never with SQL
+type sqlStorage struct {
+  conn *sql.DB
+}
+
+func isSQLitePath(path string) bool {
+  switch strings.ToLower(filepath.Ext(path)) {
+  case ".db", ".sqlite", ".sqlite3":
+    return true
+  }
+  return false
+}
+
+// openSQLConn opens the sqlite file without touching its schema
+func openSQLConn(path string) (*sql.DB, error) {
+  conn, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+  if err != nil {
+    return nil, err
+  }
+  // DB already serializes writes; a single connection keeps sqlite from fighting over locks
+  conn.SetMaxOpenConns(1)
+  return conn, nil
+}
+
+// openSQLStorage opens the sqlite file and brings its schema up to date
+func openSQLStorage(path string) (*sqlStorage, error) {
+  conn, err := openSQLConn(path)
+  if err != nil {
+    return nil, err
+  }
+  _, err = migrateUp(conn)
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  return &sqlStorage{conn: conn}, nil
+}
+
+// load reads every table whole; it only runs when the database is opened
+func (s *sqlStorage) load() (DBStructure, error) {
+  dbStructure := newDBStructure()
+  for _, t := range tables {
+    rows, err := s.conn.Query(fmt.Sprintf(`SELECT key, data FROM %s`, t.name))
+    if err != nil {
+      return dbStructure, err
+    }
+    for rows.Next() {
+      var key, data string
+      err := rows.Scan(&key, &data)
+      if err == nil {
+        err = t.put(&dbStructure, key, json.RawMessage(data))
+      }
+      if err != nil {
+        rows.Close()
+        return dbStructure, err
+      }
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return dbStructure, err
+    }
+  }
+  return dbStructure, nil
+}
+
+func (s *sqlStorage) apply(muts []mutation) error {
+  tx, err := s.conn.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  for _, m := range muts {
+    _, err := findTable(m.table)
+    if err != nil {
+      return err
+    }
+    if m.value == nil {
+      _, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE key = ?`, m.table), m.key)
+    } else {
+      err = upsertRow(tx, m.table, m.key, m.value)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+func (s *sqlStorage) replace(dbStructure DBStructure) error {
+  tx, err := s.conn.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  for _, t := range tables {
+    _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s`, t.name))
+    if err != nil {
+      return err
+    }
+    err = t.each(&dbStructure, func(key string, value interface{}) error {
+      return upsertRow(tx, t.name, key, value)
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// isEmpty reports whether no table holds any record yet
+func (s *sqlStorage) isEmpty() (bool, error) {
+  for _, t := range tables {
+    var count int
+    err := s.conn.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, t.name)).Scan(&count)
+    if err != nil {
+      return false, err
+    }
+    if count > 0 {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+func (s *sqlStorage) Close() error {
+  return s.conn.Close()
+}
+
+func upsertRow(tx *sql.Tx, tableName, key string, value interface{}) error {
+  dat, err := json.Marshal(value)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (key, data) VALUES (?, ?)
+    ON CONFLICT (key) DO UPDATE SET data = excluded.data`, tableName), key, string(dat))
+  return err
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+  "log"
+  "os"
+  "bytes"
+  "errors"
+  "encoding/base64"
+  "encoding/json"
+)
+
+// storage is where a DB keeps its DBStructure between calls;
+// load returns os.ErrNotExist when nothing has been saved yet
+type storage interface {
+  load() (DBStructure, error)
+  // apply persists the mutations as one unit
+  apply(muts []mutation) error
+  // replace throws away everything stored and writes dbStructure instead
+  replace(dbStructure DBStructure) error
+}
+
+// jsonFileStorage keeps a json snapshot of the database plus an append-only
+// write-ahead log next to it (path + ".wal"). every apply is fsynced to the log
+// before it returns, and every so often the log is compacted into a new snapshot
+type jsonFileStorage struct {
+  path       string
+  loaded     bool
+  exists     bool
+  data       DBStructure
+  wal        *os.File
+  walRecords int
+
+  // encryption at rest, see crypt.go; kek is nil for a plaintext store
+  keys  [][]byte
+  kek   []byte
+  dek   []byte
+  dekID string
+}
+
+// openJSONFileStorage reads the snapshot and replays the log on top of it.
+// with keys the store is kept encrypted, and a plaintext one gets encrypted
+// with the first key right away
+func openJSONFileStorage(path string, keys ...[]byte) (*jsonFileStorage, error) {
+  s := &jsonFileStorage{path: path, keys: keys}
+  err := s.open()
+  if err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+func (s *jsonFileStorage) walPath() string {
+  return s.path + ".wal"
+}
+
+func (s *jsonFileStorage) open() error {
+  s.data = newDBStructure()
+  dat, err := os.ReadFile(s.path)
+  if err != nil && !errors.Is(err, os.ErrNotExist) {
+    return err
+  }
+  s.exists = err == nil
+  encryptNow := false
+  if s.exists {
+    if snapshot, ok := isEncryptedSnapshot(dat); ok {
+      dat, s.kek, s.dek, err = decryptSnapshot(snapshot, s.keys)
+      if err != nil {
+        return err
+      }
+      s.dekID = snapshot.DataKeyID
+    } else if len(s.keys) > 0 {
+      encryptNow = true
+    }
+    err = json.Unmarshal(dat, &s.data)
+    if err != nil {
+      return err
+    }
+  }
+  if s.kek == nil && len(s.keys) > 0 {
+    s.kek = s.keys[0]
+    s.dek, s.dekID, err = newDataKey()
+    if err != nil {
+      return err
+    }
+  }
+
+  records, validEnd, err := replayWAL(s.walPath(), &s.data, s.decodeWALLine)
+  if err != nil {
+    return err
+  }
+  s.walRecords = records
+  if records > 0 {
+    s.exists = true
+  }
+
+  // cut off a torn tail so new records are not appended after garbage
+  info, err := os.Stat(s.walPath())
+  if err == nil && info.Size() > validEnd {
+    err = os.Truncate(s.walPath(), validEnd)
+    if err != nil {
+      return err
+    }
+  }
+  s.loaded = true
+
+  if encryptNow {
+    return s.compact()
+  }
+  return nil
+}
+
+// decodeWALLine reads one line of the log, decrypting it if needed.
+// lines sealed with an older data key were written before the compaction that
+// produced the current snapshot, so their changes are already in it
+func (s *jsonFileStorage) decodeWALLine(line []byte) (walRecord, error) {
+  record := walRecord{}
+  if prefix, encoded, ok := bytes.Cut(line, []byte(":")); ok && !bytes.HasPrefix(line, []byte("{")) {
+    if s.dek == nil {
+      return record, errors.New("wal is encrypted; set DB_ENCRYPTION_KEY")
+    }
+    if string(prefix) != s.dekID {
+      return record, errStaleWALRecord
+    }
+    sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+    if err != nil {
+      return record, err
+    }
+    line, err = unseal(s.dek, sealed)
+    if err != nil {
+      return record, err
+    }
+  }
+  err := json.Unmarshal(line, &record)
+  return record, err
+}
+
+func (s *jsonFileStorage) load() (DBStructure, error) {
+  if !s.loaded {
+    err := s.open()
+    if err != nil {
+      return newDBStructure(), err
+    }
+  }
+  if !s.exists {
+    return newDBStructure(), os.ErrNotExist
+  }
+  // callers get their own maps so they cannot change ours behind the log's back
+  return s.data.clone(), nil
+}
+
+func (s *jsonFileStorage) apply(muts []mutation) error {
+  if !s.loaded {
+    err := s.open()
+    if err != nil {
+      return err
+    }
+  }
+
+  line, err := encodeWALRecord(muts)
+  if err != nil {
+    return err
+  }
+  if s.dek != nil {
+    line, err = encryptWALLine(s.dek, s.dekID, line)
+    if err != nil {
+      return err
+    }
+  }
+  if s.wal == nil {
+    s.wal, err = os.OpenFile(s.walPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+      return err
+    }
+  }
+  err = s.appendWAL(line)
+  if err != nil {
+    return err
+  }
+
+  // the batch is durable now; replaying it later gives the same result
+  err = applyMutations(&s.data, muts)
+  if err != nil {
+    return err
+  }
+  s.exists = true
+  s.walRecords++
+
+  // the write already happened, so a failed compaction must not fail it;
+  // the log just keeps growing until the next attempt works
+  if s.walRecords >= walCompactEvery {
+    err = s.compact()
+    if err != nil {
+      log.Printf("Error compacting %s, will retry on the next write: %s", s.walPath(), err)
+    }
+  }
+  return nil
+}
+
+// appendWAL writes line to the end of the log and fsyncs it. when that fails
+// the log is cut back to where it ended, so a half-written line never ends
+// up in the middle of it; if even that fails the log is reopened, and
+// replayed, before the next write
+func (s *jsonFileStorage) appendWAL(line []byte) error {
+  info, err := s.wal.Stat()
+  if err != nil {
+    return err
+  }
+  _, err = s.wal.Write(line)
+  if err == nil {
+    err = s.wal.Sync()
+  }
+  if err == nil {
+    return nil
+  }
+
+  truncErr := s.wal.Truncate(info.Size())
+  if truncErr == nil {
+    truncErr = s.wal.Sync()
+  }
+  if truncErr != nil {
+    s.Close()
+    s.loaded = false
+    return errors.Join(err, truncErr)
+  }
+  return err
+}
+
+func (s *jsonFileStorage) replace(dbStructure DBStructure) error {
+  s.data = dbStructure.clone()
+  s.loaded = true
+  s.exists = true
+  return s.compact()
+}
+
+// compact writes the in-memory state as the new snapshot, then empties the log.
+// crashing in between is harmless: replaying puts and deletes twice is a no-op
+func (s *jsonFileStorage) compact() error {
+  err := s.writeSnapshot(s.kek, s.dek, s.dekID)
+  if err != nil {
+    return err
+  }
+  return s.truncateWAL()
+}
+
+func (s *jsonFileStorage) writeSnapshot(kek, dek []byte, dekID string) error {
+  dat, err := json.Marshal(s.data)
+  if err != nil {
+    return err
+  }
+  if kek != nil {
+    dat, err = encryptSnapshot(kek, dek, dekID, dat)
+    if err != nil {
+      return err
+    }
+  }
+  return writeFileAtomic(s.path, dat)
+}
+
+func (s *jsonFileStorage) truncateWAL() error {
+  var err error
+  if s.wal != nil {
+    err = s.wal.Truncate(0)
+    if err == nil {
+      err = s.wal.Sync()
+    }
+  } else {
+    err = os.Truncate(s.walPath(), 0)
+    if errors.Is(err, os.ErrNotExist) {
+      err = nil
+    }
+  }
+  if err != nil {
+    return err
+  }
+  s.walRecords = 0
+  return nil
+}
+
+// rotateKey re-encrypts the store under newKey with a fresh data key.
+// the new snapshot replaces the old one atomically; log lines still sealed
+// with the old data key are skipped on replay since the snapshot covers them
+func (s *jsonFileStorage) rotateKey(newKey []byte) error {
+  if s.kek == nil {
+    return errors.New("database is not encrypted; set DB_ENCRYPTION_KEY and restart first")
+  }
+  dek, dekID, err := newDataKey()
+  if err != nil {
+    return err
+  }
+
+  err = s.writeSnapshot(newKey, dek, dekID)
+  if err != nil {
+    return err
+  }
+  // from here on the file on disk only opens with the new keys
+  s.kek, s.dek, s.dekID = newKey, dek, dekID
+  s.keys = append([][]byte{newKey}, s.keys...)
+  return s.truncateWAL()
+}
+
+func (s *jsonFileStorage) Close() error {
+  if s.wal == nil {
+    return nil
+  }
+  err := s.wal.Close()
+  s.wal = nil
+  return err
+}
+
+// memoryStorage keeps the encoded database in memory;
+// storing the json instead of the struct means callers never share maps
+type memoryStorage struct {
+  dat []byte
+}
+
+func (s *memoryStorage) load() (DBStructure, error) {
+  dbStructure := newDBStructure()
+  if s.dat == nil {
+    return dbStructure, os.ErrNotExist
+  }
+  err := json.Unmarshal(s.dat, &dbStructure)
+  return dbStructure, err
+}
+
+func (s *memoryStorage) apply(muts []mutation) error {
+  dbStructure, err := s.load()
+  if err != nil {
+    return err
+  }
+  err = applyMutations(&dbStructure, muts)
+  if err != nil {
+    return err
+  }
+  return s.replace(dbStructure)
+}
+
+func (s *memoryStorage) replace(dbStructure DBStructure) error {
+  dat, err := json.Marshal(dbStructure)
+  if err != nil {
+    return err
+  }
+  s.dat = dat
+  return nil
+}
+
+// keyRotator is implemented by storages that encrypt at rest
+type keyRotator interface {
+  rotateKey(newKey []byte) error
+}
+
+// make sure every backend keeps satisfying the interface
+var (
+  _ keyRotator = (*jsonFileStorage)(nil)
+  _ storage = (*jsonFileStorage)(nil)
+  _ storage = (*memoryStorage)(nil)
+  _ storage = (*sqlStorage)(nil)
+)
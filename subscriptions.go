@@ -0,0 +1,244 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "time"
+)
+
+// the plans a user can be on
+const (
+  planFree = "free"
+  planRed  = "red"
+)
+
+// the states of a subscription; expired is never stored, a subscription
+// expires by its expires_at passing
+const (
+  subscriptionActive   = "active"
+  subscriptionCanceled = "canceled"
+  subscriptionExpired  = "expired"
+)
+
+// the Polka events that change a subscription
+const (
+  polkaUserUpgraded   = "user.upgraded"
+  polkaUserRenewed    = "user.renewed"
+  polkaUserDowngraded = "user.downgraded"
+)
+
+// how long an upgrade or renewal lasts when Polka doesn't say
+const subscriptionPeriod = 30 * 24 * time.Hour
+
+// the features a plan may include
+const (
+  featureLongChirps = "long_chirps"
+  featureEditChirps = "edit_chirps"
+)
+
+var planFeatures = map[string][]string{
+  planFree: {},
+  planRed:  {featureLongChirps, featureEditChirps},
+}
+
+// why a user without a feature is turned away
+var featureErrors = map[string]error{
+  featureLongChirps: errors.New("Longer chirps are a Chirpy Red feature"),
+  featureEditChirps: errors.New("Editing chirps is a Chirpy Red feature"),
+}
+
+var errUnknownSubscriptionEvent = errors.New("unknown subscription event")
+
+// Subscription is the plan a user pays for, if any
+type Subscription struct {
+  Plan      string     `json:"plan"`
+  Status    string     `json:"status"`
+  StartedAt *time.Time `json:"started_at"`
+  // nil for subscriptions that never run out
+  ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// SubscriptionEvent is one change to the subscription of a user, as Polka told us
+type SubscriptionEvent struct {
+  ID           int        `json:"id"`
+  UserID       int        `json:"user_id"`
+  Event        string     `json:"event"`
+  // the id Polka gave the event, so a retried delivery is applied only once
+  PolkaEventID string     `json:"polka_event_id,omitempty"`
+  // the subscription right after the event
+  Plan         string     `json:"plan"`
+  Status       string     `json:"status"`
+  ExpiresAt    *time.Time `json:"expires_at"`
+  CreatedAt    time.Time  `json:"created_at"`
+}
+
+// status is the state of the subscription at t
+func (s Subscription) status(t time.Time) string {
+  if s.Status == subscriptionActive && s.ExpiresAt != nil && !t.Before(*s.ExpiresAt) {
+    return subscriptionExpired
+  }
+  return s.Status
+}
+
+// plan is the plan whose features the user has at t
+func (s Subscription) plan(t time.Time) string {
+  if s.status(t) != subscriptionActive {
+    return planFree
+  }
+  return s.Plan
+}
+
+// entitled reports whether the user's plan includes feature at t
+func (u User) entitled(feature string, t time.Time) bool {
+  for _, f := range planFeatures[u.Subscription.plan(t)] {
+    if f == feature {
+      return true
+    }
+  }
+  return false
+}
+
+// requireEntitlement is what handlers call before a paid feature; the
+// error says which plan has it
+func requireEntitlement(user User, feature string) error {
+  if user.entitled(feature, now()) {
+    return nil
+  }
+  return featureErrors[feature]
+}
+
+// apply changes the subscription as event says, at t. expiresAt is when
+// Polka says an upgrade or renewal runs out, nil for subscriptionPeriod
+func (s *Subscription) apply(event string, t time.Time, expiresAt *time.Time) error {
+  switch event {
+  case polkaUserUpgraded, polkaUserRenewed:
+    // a renewal picks up where the paid time ends, an upgrade starts now
+    from := t
+    if event == polkaUserRenewed && s.status(t) == subscriptionActive && s.ExpiresAt != nil {
+      from = *s.ExpiresAt
+    }
+    if s.status(t) != subscriptionActive || s.Plan != planRed {
+      s.StartedAt = &t
+    }
+    if expiresAt == nil {
+      end := from.Add(subscriptionPeriod)
+      expiresAt = &end
+    }
+    s.Plan = planRed
+    s.Status = subscriptionActive
+    s.ExpiresAt = expiresAt
+  case polkaUserDowngraded:
+    s.Plan = planFree
+    s.Status = subscriptionCanceled
+    s.ExpiresAt = &t
+  default:
+    return errUnknownSubscriptionEvent
+  }
+  return nil
+}
+
+// SubscriptionEvents returns the subscription history of one user, in no particular order
+func (tx *Tx) SubscriptionEvents(userId int) []SubscriptionEvent {
+  ids := tx.db.idx.subscriptionEventsByUser[userId]
+  events := make([]SubscriptionEvent, 0, len(ids))
+  for id := range ids {
+    events = append(events, tx.db.data.SubscriptionEvents[id])
+  }
+  return events
+}
+
+func (tx *Tx) PutSubscriptionEvent(event SubscriptionEvent) error {
+  return tx.write(putRecord("subscription_events", event.ID, event))
+}
+
+// ApplySubscriptionEvent changes the subscription of a user as a Polka
+// event says and adds the event to their history. Polka retries deliveries,
+// so an event whose id was seen before leaves the subscription alone
+func (db *DB) ApplySubscriptionEvent(userId int, event string, polkaEventId string, expiresAt *time.Time) (User, error) {
+  user := User{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    user, ok = tx.User(userId)
+    if !ok {
+      return errors.New("user not found")
+    }
+    if _, seen := tx.db.idx.subscriptionEventByPolkaID[polkaEventId]; polkaEventId != "" && seen {
+      return nil
+    }
+    t := now()
+    err := user.Subscription.apply(event, t, expiresAt)
+    if err != nil {
+      return err
+    }
+    user.UpdatedAt = t
+    err = tx.PutUser(user)
+    if err != nil {
+      return err
+    }
+
+    id, err := tx.NextID("subscription_events")
+    if err != nil {
+      return err
+    }
+    return tx.PutSubscriptionEvent(SubscriptionEvent{
+      ID: id,
+      UserID: userId,
+      Event: event,
+      PolkaEventID: polkaEventId,
+      Plan: user.Subscription.Plan,
+      Status: user.Subscription.Status,
+      ExpiresAt: user.Subscription.ExpiresAt,
+      CreatedAt: t,
+    })
+  })
+  if err != nil {
+    return User{}, err
+  }
+
+  return user, nil
+}
+
+func (db *DB) GetSubscriptionEvents(userId int) ([]SubscriptionEvent, error) {
+  events := []SubscriptionEvent{}
+  err := db.View(func(tx *Tx) error {
+    events = tx.SubscriptionEvents(userId)
+    return nil
+  })
+  return events, err
+}
+
+// handlerSubscriptionRetrieve serves GET /api/subscription: the plan of the
+// caller, what it entitles them to and how it got there, the latest change first
+func (cfg *apiConfig) handlerSubscriptionRetrieve(w http.ResponseWriter, r *http.Request) {
+  type response struct {
+    Plan         string              `json:"plan"`
+    Status       string              `json:"status"`
+    StartedAt    *time.Time          `json:"started_at"`
+    ExpiresAt    *time.Time          `json:"expires_at"`
+    Entitlements []string            `json:"entitlements"`
+    History      []SubscriptionEvent `json:"history"`
+  }
+
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  history, err := cfg.DB.GetSubscriptionEvents(user.ID)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve the subscription")
+    return
+  }
+  sortBy(history, func(e SubscriptionEvent) pageCursor { return pageCursor{ID: e.ID} }, idDescending)
+
+  t := now()
+  respondWithJSON(w, http.StatusOK, response{
+    Plan: user.Subscription.Plan,
+    Status: user.Subscription.status(t),
+    StartedAt: user.Subscription.StartedAt,
+    ExpiresAt: user.Subscription.ExpiresAt,
+    Entitlements: planFeatures[user.Subscription.plan(t)],
+    History: history,
+  })
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// suspended reports whether the user is suspended at t; suspensions without
+// an end are bans
+func (u User) suspended(t time.Time) bool {
+  return u.SuspendedAt != nil && (u.SuspendedUntil == nil || t.Before(*u.SuspendedUntil))
+}
+
+// suspensionError tells a suspended user why they are turned away
+func suspensionError(u User) error {
+  msg := "Your account is suspended"
+  if u.SuspendedUntil != nil {
+    msg += " until " + u.SuspendedUntil.Format(time.RFC3339)
+  }
+  if u.SuspensionReason != "" {
+    msg += ": " + u.SuspensionReason
+  }
+  return errors.New(msg)
+}
+
+// suspend suspends the user from t until until, for good when until is nil.
+// a new suspension replaces whatever the user was suspended for before
+func (u *User) suspend(t time.Time, until *time.Time, reason string, hideChirps bool) {
+  u.SuspendedAt = &t
+  u.SuspendedUntil = until
+  u.SuspensionReason = reason
+  u.SuspensionHidesChirps = hideChirps
+  u.UpdatedAt = t
+}
+
+// withoutSuspendedAuthors leaves out the chirps of authors whose suspension
+// hides them, for as long as it lasts
+func (tx *Tx) withoutSuspendedAuthors(chirps []Chirp) []Chirp {
+  if len(tx.db.idx.chirpsHiddenBySuspension) == 0 {
+    return chirps
+  }
+  t := now()
+  visible := make([]Chirp, 0, len(chirps))
+  for _, chirp := range chirps {
+    if tx.suspensionHides(chirp.Author_ID, t) {
+      continue
+    }
+    visible = append(visible, chirp)
+  }
+  return visible
+}
+
+// suspensionHides reports whether the author's chirps are hidden at t
+func (tx *Tx) suspensionHides(authorId int, t time.Time) bool {
+  if _, ok := tx.db.idx.chirpsHiddenBySuspension[authorId]; !ok {
+    return false
+  }
+  author, _ := tx.User(authorId)
+  return author.suspended(t)
+}
+
+// SuspendUser suspends a user for duration, or for good when it is zero
+func (db *DB) SuspendUser(userId int, duration time.Duration, reason string, hideChirps bool) (User, error) {
+  return db.updateUser(userId, func(user *User) error {
+    t := now()
+    var until *time.Time
+    if duration > 0 {
+      end := t.Add(duration)
+      until = &end
+    }
+    user.suspend(t, until, reason, hideChirps)
+    return nil
+  })
+}
+
+// LiftSuspension ends a suspension before its time; tokens the user still
+// has work again
+func (db *DB) LiftSuspension(userId int) (User, error) {
+  return db.updateUser(userId, func(user *User) error {
+    if user.SuspendedAt == nil {
+      return errors.New("this user is not suspended")
+    }
+    user.SuspendedAt = nil
+    user.SuspendedUntil = nil
+    user.SuspensionReason = ""
+    user.SuspensionHidesChirps = false
+    user.UpdatedAt = now()
+    return nil
+  })
+}
+
+// suspensionResponse is what admins see of a suspension
+type suspensionResponse struct {
+  UserID         int        `json:"user_id"`
+  SuspendedAt    *time.Time `json:"suspended_at"`
+  SuspendedUntil *time.Time `json:"suspended_until"`
+  Reason         string     `json:"reason"`
+  HideChirps     bool       `json:"hide_chirps"`
+}
+
+func newSuspensionResponse(user User) suspensionResponse {
+  return suspensionResponse{
+    UserID: user.ID,
+    SuspendedAt: user.SuspendedAt,
+    SuspendedUntil: user.SuspendedUntil,
+    Reason: user.SuspensionReason,
+    HideChirps: user.SuspensionHidesChirps,
+  }
+}
+
+// handlerUsersSuspend serves POST /admin/users/{id}/suspension with
+// {"reason": "...", "duration": "72h", "hide_chirps": true}; without a
+// duration the suspension is permanent
+func (cfg *apiConfig) handlerUsersSuspend(w http.ResponseWriter, r *http.Request) {
+  type parameters struct {
+    Reason     string `json:"reason"`
+    Duration   string `json:"duration"`
+    HideChirps bool   `json:"hide_chirps"`
+  }
+
+  admin, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+  if id == admin.ID {
+    respondWithError(w, http.StatusBadRequest, "You cannot suspend yourself")
+    return
+  }
+
+  decoder := json.NewDecoder(r.Body)
+  params := parameters{}
+  err = decoder.Decode(&params)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+    return
+  }
+  reason := strings.TrimSpace(params.Reason)
+  if reason == "" {
+    respondWithError(w, http.StatusBadRequest, "A suspension needs a reason")
+    return
+  }
+  duration := time.Duration(0)
+  if params.Duration != "" {
+    duration, err = time.ParseDuration(params.Duration)
+    if err != nil || duration <= 0 {
+      respondWithError(w, http.StatusBadRequest, fmt.Sprintf("duration must be a positive duration like 72h, got %q", params.Duration))
+      return
+    }
+  }
+
+  user, err := cfg.DB.SuspendUser(id, duration, reason, params.HideChirps)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, newSuspensionResponse(user))
+}
+
+// handlerUsersUnsuspend serves DELETE /admin/users/{id}/suspension
+func (cfg *apiConfig) handlerUsersUnsuspend(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  _, err = cfg.DB.LiftSuspension(id)
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
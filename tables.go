@@ -0,0 +1,240 @@
+package main
+
+import (
+  "fmt"
+  "encoding/json"
+  "strconv"
+)
+
+// mutation is a single change to one record of one table;
+// a nil value means the record was deleted
+type mutation struct {
+  table string
+  key   string
+  value interface{}
+}
+
+func putRecord(tableName string, id int, value interface{}) mutation {
+  return mutation{table: tableName, key: strconv.Itoa(id), value: value}
+}
+
+func deleteRecord(tableName string, id int) mutation {
+  return mutation{table: tableName, key: strconv.Itoa(id)}
+}
+
+func putNamedRecord(tableName string, key string, value interface{}) mutation {
+  return mutation{table: tableName, key: key, value: value}
+}
+
+// table knows how to move the records of one DBStructure map in and out
+// of the generic key/value shape the storages work with
+type table struct {
+  name string
+  // put accepts either the record itself or its json encoding
+  put  func(ds *DBStructure, key string, value interface{}) error
+  del  func(ds *DBStructure, key string) error
+  // get returns the record stored under key, or nil when there is none
+  get  func(ds *DBStructure, key string) interface{}
+  each func(ds *DBStructure, fn func(key string, value interface{}) error) error
+}
+
+// every table in DBStructure must be listed here, otherwise
+// the storages will silently drop its records
+var tables = []table{
+  intTable("users", func(ds *DBStructure) *map[int]User { return &ds.Users }),
+  intTable("chirps", func(ds *DBStructure) *map[int]Chirp { return &ds.Chirps }),
+  intTable("notifications", func(ds *DBStructure) *map[int]Notification { return &ds.Notifications }),
+  intTable("revisions", func(ds *DBStructure) *map[int]Revision { return &ds.Revisions }),
+  intTable("chirp_flags", func(ds *DBStructure) *map[int]ChirpFlags { return &ds.ChirpFlags }),
+  intTable("reports", func(ds *DBStructure) *map[int]Report { return &ds.Reports }),
+  intTable("moderation_actions", func(ds *DBStructure) *map[int]ModerationAction { return &ds.ModerationActions }),
+  intTable("subscription_events", func(ds *DBStructure) *map[int]SubscriptionEvent { return &ds.SubscriptionEvents }),
+  stringTable("reactions", func(ds *DBStructure) *map[string]Reaction { return &ds.Reactions }),
+  stringTable("follows", func(ds *DBStructure) *map[string]Follow { return &ds.Follows }),
+  stringTable("sequences", func(ds *DBStructure) *map[string]int { return &ds.Sequences }),
+}
+
+func findTable(name string) (table, error) {
+  for _, t := range tables {
+    if t.name == name {
+      return t, nil
+    }
+  }
+  return table{}, fmt.Errorf("unknown table %q", name)
+}
+
+func intTable[V any](name string, field func(*DBStructure) *map[int]V) table {
+  return table{
+    name: name,
+    put: func(ds *DBStructure, key string, value interface{}) error {
+      id, err := strconv.Atoi(key)
+      if err != nil {
+        return err
+      }
+      v, ok := value.(V)
+      if !ok {
+        raw, err := json.Marshal(value)
+        if err != nil {
+          return err
+        }
+        err = json.Unmarshal(raw, &v)
+        if err != nil {
+          return err
+        }
+      }
+      m := field(ds)
+      if *m == nil {
+        *m = map[int]V{}
+      }
+      (*m)[id] = v
+      return nil
+    },
+    del: func(ds *DBStructure, key string) error {
+      id, err := strconv.Atoi(key)
+      if err != nil {
+        return err
+      }
+      delete(*field(ds), id)
+      return nil
+    },
+    get: func(ds *DBStructure, key string) interface{} {
+      id, err := strconv.Atoi(key)
+      if err != nil {
+        return nil
+      }
+      v, ok := (*field(ds))[id]
+      if !ok {
+        return nil
+      }
+      return v
+    },
+    each: func(ds *DBStructure, fn func(key string, value interface{}) error) error {
+      for id, v := range *field(ds) {
+        err := fn(strconv.Itoa(id), v)
+        if err != nil {
+          return err
+        }
+      }
+      return nil
+    },
+  }
+}
+
+func stringTable[V any](name string, field func(*DBStructure) *map[string]V) table {
+  return table{
+    name: name,
+    put: func(ds *DBStructure, key string, value interface{}) error {
+      v, ok := value.(V)
+      if !ok {
+        raw, err := json.Marshal(value)
+        if err != nil {
+          return err
+        }
+        err = json.Unmarshal(raw, &v)
+        if err != nil {
+          return err
+        }
+      }
+      m := field(ds)
+      if *m == nil {
+        *m = map[string]V{}
+      }
+      (*m)[key] = v
+      return nil
+    },
+    del: func(ds *DBStructure, key string) error {
+      delete(*field(ds), key)
+      return nil
+    },
+    get: func(ds *DBStructure, key string) interface{} {
+      v, ok := (*field(ds))[key]
+      if !ok {
+        return nil
+      }
+      return v
+    },
+    each: func(ds *DBStructure, fn func(key string, value interface{}) error) error {
+      for key, v := range *field(ds) {
+        err := fn(key, v)
+        if err != nil {
+          return err
+        }
+      }
+      return nil
+    },
+  }
+}
+
+// newDBStructure returns an empty structure with every map ready to use
+func newDBStructure() DBStructure {
+  return DBStructure{
+    Chirps: map[int]Chirp{},
+    Users: map[int]User{},
+    Notifications: map[int]Notification{},
+    Reactions: map[string]Reaction{},
+    Follows: map[string]Follow{},
+    Revisions: map[int]Revision{},
+    ChirpFlags: map[int]ChirpFlags{},
+    Reports: map[int]Report{},
+    ModerationActions: map[int]ModerationAction{},
+    SubscriptionEvents: map[int]SubscriptionEvent{},
+    Sequences: map[string]int{},
+  }
+}
+
+// nextID returns the next id of tableName without reserving it, see Tx.NextID;
+// ids are never reused, even after the record holding the highest one is deleted
+func (ds *DBStructure) nextID(tableName string) int {
+  seq, ok := ds.Sequences[tableName]
+  if !ok {
+    // databases from before sequences existed start after their highest id
+    seq = ds.maxID(tableName)
+  }
+  return seq + 1
+}
+
+func (ds *DBStructure) maxID(tableName string) int {
+  maxID := 0
+  t, err := findTable(tableName)
+  if err != nil {
+    return 0
+  }
+  t.each(ds, func(key string, _ interface{}) error {
+    id, err := strconv.Atoi(key)
+    if err == nil && id > maxID {
+      maxID = id
+    }
+    return nil
+  })
+  return maxID
+}
+
+// clone copies every table into fresh maps
+func (ds *DBStructure) clone() DBStructure {
+  c := newDBStructure()
+  for _, t := range tables {
+    t.each(ds, func(key string, value interface{}) error {
+      return t.put(&c, key, value)
+    })
+  }
+  return c
+}
+
+// applyMutations replays muts on top of ds, in order
+func applyMutations(ds *DBStructure, muts []mutation) error {
+  for _, m := range muts {
+    t, err := findTable(m.table)
+    if err != nil {
+      return err
+    }
+    if m.value == nil {
+      err = t.del(ds, m.key)
+    } else {
+      err = t.put(ds, m.key, m.value)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestNextIDWithoutSequence(t *testing.T) {
+  // databases from before sequences existed carry on after their highest id
+  ds := newDBStructure()
+  ds.Chirps[1] = Chirp{ID: 1}
+  ds.Chirps[5] = Chirp{ID: 5}
+  if id := ds.nextID("chirps"); id != 6 {
+    t.Fatalf("nextID(chirps) = %d, want 6", id)
+  }
+  if id := ds.nextID("users"); id != 1 {
+    t.Fatalf("nextID(users) = %d, want 1", id)
+  }
+
+  // once there is a sequence it wins, even over a lower highest id
+  ds.Sequences["chirps"] = 9
+  if id := ds.nextID("chirps"); id != 10 {
+    t.Fatalf("nextID(chirps) = %d, want 10", id)
+  }
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "errors"
+  "math"
+  "net/http"
+  "sort"
+  "strconv"
+  "time"
+  "unicode"
+)
+
+const maxTagLength = 64
+
+// extractHashtags returns the distinct hashtags of body, case-folded and without the #.
+// a tag starts after a # that does not follow a word character, so "a#b" and "#" are not tags
+func extractHashtags(body string) []string {
+  tags := []string{}
+  seen := map[string]struct{}{}
+  runes := []rune(body)
+  for i := 0; i < len(runes); i++ {
+    if runes[i] != '#' || (i > 0 && isTagRune(runes[i-1])) {
+      continue
+    }
+    end := i + 1
+    for end < len(runes) && isTagRune(runes[end]) {
+      end++
+    }
+    if end == i+1 || end-i-1 > maxTagLength {
+      i = end - 1
+      continue
+    }
+
+    tag := foldCase(string(runes[i+1:end]))
+    if _, ok := seen[tag]; !ok {
+      seen[tag] = struct{}{}
+      tags = append(tags, tag)
+    }
+    i = end - 1
+  }
+  return tags
+}
+
+func isTagRune(r rune) bool {
+  return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// ChirpsByTag returns every chirp tagged with tag, in no particular order
+func (tx *Tx) ChirpsByTag(tag string) []Chirp {
+  ids := tx.db.idx.chirpsByTag[foldCase(tag)]
+  chirps := make([]Chirp, 0, len(ids))
+  for id := range ids {
+    chirps = append(chirps, tx.db.data.Chirps[id])
+  }
+  return chirps
+}
+
+type trendingTag struct {
+  Tag   string  `json:"tag"`
+  Score float64 `json:"score"`
+  Count int     `json:"count"`
+}
+
+// TrendingTags ranks the tags used in the window before at. every use counts
+// for less the older it is, halving every halfLife, so a burst of recent
+// chirps beats a tag that was steadily used all day
+func (tx *Tx) TrendingTags(at time.Time, window, halfLife time.Duration, limit int) []trendingTag {
+  since := at.Add(-window)
+  trending := []trendingTag{}
+  for tag, ids := range tx.db.idx.chirpsByTag {
+    tt := trendingTag{Tag: tag}
+    for id := range ids {
+      createdAt := tx.db.data.Chirps[id].CreatedAt
+      if createdAt.Before(since) || createdAt.After(at) {
+        continue
+      }
+      age := at.Sub(createdAt)
+      tt.Score += math.Exp2(-age.Seconds() / halfLife.Seconds())
+      tt.Count++
+    }
+    if tt.Count > 0 {
+      trending = append(trending, tt)
+    }
+  }
+
+  sort.Slice(trending, func(i, j int) bool {
+    if trending[i].Score == trending[j].Score {
+      return trending[i].Tag < trending[j].Tag
+    }
+    return trending[i].Score > trending[j].Score
+  })
+  if len(trending) > limit {
+    trending = trending[:limit]
+  }
+  return trending
+}
+
+func (db *DB) GetChirpsByTag(tag string) ([]Chirp, error) {
+  chirps := []Chirp{}
+  err := db.View(func(tx *Tx) error {
+    chirps = tx.ChirpsByTag(tag)
+    return nil
+  })
+  return chirps, err
+}
+
+func (db *DB) GetTrendingTags(window, halfLife time.Duration, limit int) ([]trendingTag, error) {
+  trending := []trendingTag{}
+  err := db.View(func(tx *Tx) error {
+    trending = tx.TrendingTags(now(), window, halfLife, limit)
+    return nil
+  })
+  return trending, err
+}
+
+// handlerTagChirps serves GET /api/tags/{tag}/chirps, newest first unless ?sort= says otherwise
+func (cfg *apiConfig) handlerTagChirps(w http.ResponseWriter, r *http.Request) {
+  sortOrder := r.URL.Query().Get("sort")
+  if sortOrder == "" { sortOrder = "-created_at" }
+
+  dbChirps, err := cfg.DB.GetChirpsByTag(r.PathValue("tag"))
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve chirps")
+    return
+  }
+
+  chirps, err := paginateChirps(w, r, dbChirps, sortOrder)
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, chirps)
+}
+
+// handlerTagsTrending serves GET /api/tags/trending?window=24h&half_life=6h&limit=10
+func (cfg *apiConfig) handlerTagsTrending(w http.ResponseWriter, r *http.Request) {
+  window, errW := durationParam(r, "window", 24 * time.Hour)
+  halfLife, errH := durationParam(r, "half_life", 6 * time.Hour)
+  if err := errors.Join(errW, errH); err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  limit := 10
+  if limitString := r.URL.Query().Get("limit"); limitString != "" {
+    l, err := strconv.Atoi(limitString)
+    if err != nil || l < 1 {
+      respondWithError(w, http.StatusBadRequest, "limit must be a positive number")
+      return
+    }
+    limit = min(l, maxPageLimit)
+  }
+
+  trending, err := cfg.DB.GetTrendingTags(window, halfLife, limit)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not compute trending tags")
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, trending)
+}
+
+// durationParam reads a positive duration like "90m" from the query string
+func durationParam(r *http.Request, name string, fallback time.Duration) (time.Duration, error) {
+  value := r.URL.Query().Get(name)
+  if value == "" {
+    return fallback, nil
+  }
+  d, err := time.ParseDuration(value)
+  if err != nil || d <= 0 {
+    return 0, errors.New(name + " must be a positive duration like 24h")
+  }
+  return d, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestExtractHashtags(t *testing.T) {
+  longest := strings.Repeat("a", maxTagLength)
+  cases := []struct {
+    body string
+    want []string
+  }{
+    {"#go is fun", []string{"go"}},
+    {"ends with #go", []string{"go"}},
+    {"(#go), #rust!", []string{"go", "rust"}},
+    // a # in the middle of a word is not a tag, nor is one on its own
+    {"a#b", []string{}},
+    {"#", []string{}},
+    {"# go", []string{}},
+    {"##go", []string{"go"}},
+    {"#go#rust", []string{"go"}},
+    {"#snake_case #v2", []string{"snake_case", "v2"}},
+    {"#" + longest, []string{longest}},
+    {"#" + longest + "a", []string{}},
+    // folded and counted once
+    {"#Go #GO #go", []string{"go"}},
+    {"#Straße #STRASSE", []string{"strasse"}},
+    {"#café", []string{"café"}},
+  }
+  for _, c := range cases {
+    if got := extractHashtags(c.body); fmt.Sprint(got) != fmt.Sprint(c.want) {
+      t.Errorf("extractHashtags(%q) = %q, want %q", c.body, got, c.want)
+    }
+  }
+}
+
+// createTagged stores a chirp with its tags filled in, the way the handler does
+func createTagged(t *testing.T, db *DB, author User, body string) Chirp {
+  t.Helper()
+  chirp, err := db.CreateChirp(Chirp{Body: body, Tags: extractHashtags(body)}, author)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return chirp
+}
+
+func TestChirpsByTagFoldCase(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  for _, body := range []string{"learning #GoLang", "more #golang", "#golangs are different"} {
+    createTagged(t, db, author, body)
+  }
+
+  for _, tag := range []string{"golang", "GOLANG", "GoLang"} {
+    chirps, _ := db.GetChirpsByTag(tag)
+    if len(chirps) != 2 {
+      t.Fatalf("GetChirpsByTag(%q) = %v", tag, chirpIDs(chirps))
+    }
+  }
+}
+
+func TestTrendingTagsDecay(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  author, _ := db.CreateUser("alice@example.com", "hunter2")
+  at := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+  // #steady every hour for a day, #burst five times in the last ten minutes,
+  // #stale a lot but outside the window
+  ages := map[int]time.Duration{}
+  for h := 1; h <= 24; h++ {
+    chirp := createTagged(t, db, author, "still going #steady")
+    ages[chirp.ID] = time.Duration(h) * time.Hour
+  }
+  for m := 1; m <= 5; m++ {
+    chirp := createTagged(t, db, author, "look #burst")
+    ages[chirp.ID] = time.Duration(m*2) * time.Minute
+  }
+  for i := 0; i < 30; i++ {
+    chirp := createTagged(t, db, author, "old news #stale")
+    ages[chirp.ID] = 30 * time.Hour
+  }
+  err = db.Update(func(tx *Tx) error {
+    for id, age := range ages {
+      chirp, _ := tx.Chirp(id)
+      chirp.CreatedAt = at.Add(-age)
+      err := tx.PutChirp(chirp)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  trending := []trendingTag{}
+  db.View(func(tx *Tx) error {
+    trending = tx.TrendingTags(at, 24*time.Hour, time.Hour, 10)
+    return nil
+  })
+  if len(trending) != 2 || trending[0].Tag != "burst" || trending[1].Tag != "steady" {
+    t.Fatalf("trending = %+v", trending)
+  }
+  // used more often, but it counts for less
+  if trending[0].Count != 5 || trending[1].Count != 24 {
+    t.Fatalf("counts = %+v", trending)
+  }
+
+  // with a slow enough decay steady use wins again
+  db.View(func(tx *Tx) error {
+    trending = tx.TrendingTags(at, 24*time.Hour, 48*time.Hour, 1)
+    return nil
+  })
+  if len(trending) != 1 || trending[0].Tag != "steady" {
+    t.Fatalf("trending with a 48h half-life = %+v", trending)
+  }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+  "container/heap"
+  "net/http"
+  "sort"
+)
+
+// timelineKey places a chirp in the timelines, which run newest first
+func timelineKey(chirp Chirp) pageCursor {
+  return pageCursor{Sort: "-created_at", Time: chirp.CreatedAt, ID: chirp.ID}
+}
+
+// the index keeps the chirps of every author sorted oldest first, so a
+// timeline only has to merge lists instead of sorting everything again
+func insertSorted(list []pageCursor, key pageCursor) []pageCursor {
+  i := sort.Search(len(list), func(i int) bool { return timeAscending(key, list[i]) })
+  list = append(list, pageCursor{})
+  copy(list[i+1:], list[i:])
+  list[i] = key
+  return list
+}
+
+func removeSorted(list []pageCursor, key pageCursor) []pageCursor {
+  i := sort.Search(len(list), func(i int) bool { return !timeAscending(list[i], key) })
+  if i < len(list) && list[i].ID == key.ID {
+    list = append(list[:i], list[i+1:]...)
+  }
+  return list
+}
+
+// timelineHead is the newest chirp of one author not taken yet
+type timelineHead struct {
+  list []pageCursor
+  pos  int
+}
+
+type timelineHeap []timelineHead
+
+func (h timelineHeap) Len() int { return len(h) }
+func (h timelineHeap) Less(i, j int) bool {
+  return timeDescending(h[i].list[h[i].pos], h[j].list[h[j].pos])
+}
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timelineHeap) Push(x any)   { *h = append(*h, x.(timelineHead)) }
+func (h *timelineHeap) Pop() any {
+  old := *h
+  head := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return head
+}
+
+// Timeline returns up to limit chirps of userId and everyone they follow,
+// newest first and after the cursor if there is one, plus the cursor of
+// the next page. it merges the per-author lists with a heap, so a page
+// costs O(authors + limit log authors) whatever those authors ever wrote.
+// like the chirp listing it leaves out authors whose suspension hides them
+func (tx *Tx) Timeline(userId int, after *pageCursor, limit int) ([]Chirp, *pageCursor) {
+  authors := []int{userId}
+  for followeeId := range tx.db.idx.following[userId] {
+    authors = append(authors, followeeId)
+  }
+
+  t := now()
+  h := timelineHeap{}
+  for _, authorId := range authors {
+    if tx.suspensionHides(authorId, t) {
+      continue
+    }
+    list := tx.db.idx.authorTimelines[authorId]
+    end := len(list)
+    if after != nil {
+      // everything older than the cursor is still to come
+      end = sort.Search(len(list), func(i int) bool { return !timeDescending(*after, list[i]) })
+    }
+    if end > 0 {
+      h = append(h, timelineHead{list: list, pos: end - 1})
+    }
+  }
+  heap.Init(&h)
+
+  chirps := []Chirp{}
+  for h.Len() > 0 && len(chirps) < limit {
+    head := &h[0]
+    chirps = append(chirps, tx.db.data.Chirps[head.list[head.pos].ID])
+    head.pos--
+    if head.pos < 0 {
+      heap.Pop(&h)
+    } else {
+      heap.Fix(&h, 0)
+    }
+  }
+
+  if h.Len() == 0 || len(chirps) == 0 {
+    return chirps, nil
+  }
+  next := timelineKey(chirps[len(chirps)-1])
+  return chirps, &next
+}
+
+func (db *DB) GetTimeline(userId int, after *pageCursor, limit int) ([]Chirp, *pageCursor, error) {
+  chirps := []Chirp{}
+  var next *pageCursor
+  err := db.View(func(tx *Tx) error {
+    chirps, next = tx.Timeline(userId, after, limit)
+    return nil
+  })
+  return chirps, next, err
+}
+
+// handlerTimeline serves GET /api/timeline, the chirps of the user and
+// of everyone they follow, newest first and always paged
+func (cfg *apiConfig) handlerTimeline(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  params, err := parsePageParams(r, "-created_at")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  if params.limit == 0 {
+    params.limit = defaultPageLimit
+  }
+
+  chirps, next, err := cfg.DB.GetTimeline(user.ID, params.after, params.limit)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve the timeline")
+    return
+  }
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, chirps)
+}
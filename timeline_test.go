@@ -0,0 +1,124 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+// setCreatedAt moves chirps around in time, id -> minutes after t0
+func setCreatedAt(t *testing.T, db *DB, t0 time.Time, minutes map[int]int) {
+  t.Helper()
+  err := db.Update(func(tx *Tx) error {
+    for id, m := range minutes {
+      chirp, _ := tx.Chirp(id)
+      chirp.CreatedAt = t0.Add(time.Duration(m) * time.Minute)
+      err := tx.PutChirp(chirp)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+// readTimeline pages through the timeline of userId, limit chirps at a time
+func readTimeline(t *testing.T, db *DB, userId, limit int) [][]int {
+  t.Helper()
+  pages := [][]int{}
+  var after *pageCursor
+  for {
+    chirps, next, err := db.GetTimeline(userId, after, limit)
+    if err != nil {
+      t.Fatal(err)
+    }
+    pages = append(pages, chirpIDs(chirps))
+    if next == nil {
+      return pages
+    }
+    after = next
+  }
+}
+
+func TestTimelineMergesFolloweesNewestFirst(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  carol, _ := db.CreateUser("carol@example.com", "hunter2")
+  dave, _ := db.CreateUser("dave@example.com", "hunter2")
+  createChirps(t, db, alice, "a1", "a2")   // 1, 2
+  createChirps(t, db, bob, "b1", "b2", "b3") // 3, 4, 5
+  createChirps(t, db, carol, "c1", "c2")   // 6, 7
+  createChirps(t, db, dave, "d1")          // 8, not followed
+
+  // interleaved, with 4 and 6 posted in the same minute
+  t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+  setCreatedAt(t, db, t0, map[int]int{1: 0, 3: 1, 6: 5, 2: 3, 4: 5, 7: 4, 5: 7, 8: 6})
+  for _, followee := range []int{bob.ID, carol.ID} {
+    err = db.SetFollow(alice, followee, true)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  want := "[5 6 4 7 2 3 1]"
+  if pages := readTimeline(t, db, alice.ID, 10); fmt.Sprint(pages[0]) != want || len(pages) != 1 {
+    t.Fatalf("timeline = %v, want %s", pages, want)
+  }
+  // a page boundary in the tie neither skips nor repeats
+  if pages := readTimeline(t, db, alice.ID, 2); fmt.Sprint(pages) != "[[5 6] [4 7] [2 3] [1]]" {
+    t.Fatalf("timeline in pages of 2 = %v", pages)
+  }
+  if pages := readTimeline(t, db, alice.ID, 3); fmt.Sprint(pages) != "[[5 6 4] [7 2 3] [1]]" {
+    t.Fatalf("timeline in pages of 3 = %v", pages)
+  }
+  // following goes one way
+  if pages := readTimeline(t, db, bob.ID, 10); fmt.Sprint(pages) != "[[5 4 3]]" {
+    t.Fatalf("bob's timeline = %v", pages)
+  }
+
+  err = db.SetFollow(alice, carol.ID, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if pages := readTimeline(t, db, alice.ID, 10); fmt.Sprint(pages) != "[[5 4 2 3 1]]" {
+    t.Fatalf("timeline after unfollowing carol = %v", pages)
+  }
+}
+
+func TestTimelineLeavesOutSuspendedAuthors(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  carol, _ := db.CreateUser("carol@example.com", "hunter2")
+  createChirps(t, db, alice, "a1")
+  createChirps(t, db, bob, "b1")
+  createChirps(t, db, carol, "c1")
+  db.SetFollow(alice, bob.ID, true)
+  db.SetFollow(alice, carol.ID, true)
+
+  // only a suspension that hides the chirps takes them off timelines
+  db.SuspendUser(bob.ID, 0, "spam", true)
+  db.SuspendUser(carol.ID, 0, "rude", false)
+  pages := readTimeline(t, db, alice.ID, 10)
+  if ids := fmt.Sprint(pages); ids != "[[3 1]]" {
+    t.Fatalf("timeline while bob is suspended = %s", ids)
+  }
+
+  _, err = db.LiftSuspension(bob.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ids := fmt.Sprint(readTimeline(t, db, alice.ID, 10)); ids != "[[3 2 1]]" {
+    t.Fatalf("timeline after lifting the suspension = %s", ids)
+  }
+}
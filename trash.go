@@ -0,0 +1,222 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// how long deleted chirps stay restorable unless CHIRP_TRASH_RETENTION says otherwise
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// hidden chirps are in the trash, only hold a thread together, are not
+// published yet or were taken down by a moderator; they are left out of
+// every listing
+func (c Chirp) hidden() bool {
+  return c.Deleted || c.DeletedAt != nil || c.unpublished() || c.HiddenAt != nil
+}
+
+// inThread reports whether a chirp shows up in threads at all. tombstones
+// and chirps taken down by a moderator do, as placeholders; drafts and the
+// trash are nobody's business but their author's, like everywhere else
+func (c Chirp) inThread() bool {
+  return c.Deleted || (!c.unpublished() && c.DeletedAt == nil)
+}
+
+// placeholder is how a hidden chirp shows up in a thread: where it was, not what it said
+func (c Chirp) placeholder() Chirp {
+  if !c.hidden() {
+    return c
+  }
+  c.Body = ""
+  c.Tags = []string{}
+  c.Mentions = []Mention{}
+  c.Deleted = true
+  return c
+}
+
+// Trash returns the deleted chirps of one author that can still be restored, in no particular order
+func (tx *Tx) Trash(authorId int) []Chirp {
+  ids := tx.db.idx.trashByAuthor[authorId]
+  chirps := make([]Chirp, 0, len(ids))
+  for id := range ids {
+    chirps = append(chirps, tx.db.data.Chirps[id])
+  }
+  return chirps
+}
+
+// TrashChirp moves a chirp of user to their trash; everything about it
+// is kept until it is restored or purged, but a reply stops counting on
+// its parent while it is in there
+func (db *DB) TrashChirp(id int, user User) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    chirp, ok = tx.Chirp(id)
+    if !ok || chirp.hidden() {
+      return errors.New("chirp not found")
+    }
+    if chirp.Author_ID != user.ID {
+      return errNotChirpAuthor
+    }
+    t := now()
+    chirp.DeletedAt = &t
+    err := tx.PutChirp(chirp)
+    if err != nil || chirp.InReplyTo == 0 {
+      return err
+    }
+    return tx.countReply(chirp, -1)
+  })
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  return chirp, nil
+}
+
+// RestoreChirp takes a chirp of user back out of the trash, as long as
+// it went in less than retention ago
+func (db *DB) RestoreChirp(id int, user User, retention time.Duration) (Chirp, error) {
+  chirp := Chirp{}
+  err := db.Update(func(tx *Tx) error {
+    var ok bool
+    chirp, ok = tx.Chirp(id)
+    if !ok || chirp.Deleted || chirp.DeletedAt == nil {
+      return errors.New("chirp not found in the trash")
+    }
+    if chirp.Author_ID != user.ID {
+      return errNotChirpAuthor
+    }
+    // the janitor may just not have come around yet
+    if now().Sub(*chirp.DeletedAt) > retention {
+      return errors.New("this chirp was deleted too long ago to be restored")
+    }
+    chirp.DeletedAt = nil
+    err := tx.PutChirp(chirp)
+    if err != nil || !chirp.countsAsReply() {
+      return err
+    }
+    return tx.countReply(chirp, 1)
+  })
+  if err != nil {
+    return Chirp{}, err
+  }
+
+  return chirp, nil
+}
+
+func (db *DB) GetTrash(authorId int) ([]Chirp, error) {
+  chirps := []Chirp{}
+  err := db.View(func(tx *Tx) error {
+    chirps = tx.Trash(authorId)
+    return nil
+  })
+  return chirps, err
+}
+
+// PurgeTrash deletes for good every chirp that went into the trash before
+// cutoff and returns how many there were
+func (db *DB) PurgeTrash(cutoff time.Time) (int, error) {
+  purged := 0
+  err := db.Update(func(tx *Tx) error {
+    purged = 0
+    for authorId := range tx.db.idx.trashByAuthor {
+      for _, chirp := range tx.Trash(authorId) {
+        if !chirp.DeletedAt.Before(cutoff) {
+          continue
+        }
+        err := tx.removeChirp(chirp)
+        if err != nil {
+          return err
+        }
+        purged++
+      }
+    }
+    return nil
+  })
+  return purged, err
+}
+
+// runTrashJanitor purges expired chirps from the trash every interval, forever
+func (cfg *apiConfig) runTrashJanitor(interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for range ticker.C {
+    purged, err := cfg.DB.PurgeTrash(now().Add(-cfg.trashRetention))
+    if err != nil {
+      log.Printf("Error purging the trash: %s", err)
+      continue
+    }
+    if purged > 0 {
+      log.Printf("Purged %d chirps from the trash", purged)
+    }
+  }
+}
+
+// trashedChirp is a chirp as it shows up in the trash of its author
+type trashedChirp struct {
+  Chirp
+  PurgeAt time.Time `json:"purge_at"`
+}
+
+// handlerTrashRetrieve serves GET /api/trash, the most recently deleted chirps first
+func (cfg *apiConfig) handlerTrashRetrieve(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  chirps, err := cfg.DB.GetTrash(user.ID)
+  if err != nil {
+    respondWithError(w, http.StatusInternalServerError, "Could not retrieve the trash")
+    return
+  }
+  trash := make([]trashedChirp, 0, len(chirps))
+  for _, chirp := range chirps {
+    trash = append(trash, trashedChirp{Chirp: chirp, PurgeAt: chirp.DeletedAt.Add(cfg.trashRetention)})
+  }
+
+  params, err := parsePageParams(r, "-deleted_at")
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  keyOf := func(c trashedChirp) pageCursor {
+    return pageCursor{Sort: "-deleted_at", Time: *c.DeletedAt, ID: c.ID}
+  }
+  sortBy(trash, keyOf, timeDescending)
+  page, next := paginate(trash, params, keyOf, timeDescending)
+  setNextLink(w, r, params, next)
+
+  respondWithJSON(w, http.StatusOK, page)
+}
+
+// handlerChirpsRestore serves POST /api/chirps/{id}/restore
+func (cfg *apiConfig) handlerChirpsRestore(w http.ResponseWriter, r *http.Request) {
+  user, err := cfg.authenticatedUser(r)
+  if err != nil {
+    respondWithError(w, http.StatusUnauthorized, err.Error())
+    return
+  }
+
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    respondWithError(w, http.StatusBadRequest, "couldn't retrieve id from the request")
+    return
+  }
+
+  chirp, err := cfg.DB.RestoreChirp(id, user, cfg.trashRetention)
+  if errors.Is(err, errNotChirpAuthor) {
+    respondWithError(w, http.StatusForbidden, err.Error())
+    return
+  }
+  if err != nil {
+    respondWithError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, chirp)
+}
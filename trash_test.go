@@ -0,0 +1,188 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func replyCount(t *testing.T, db *DB, id int) int {
+  t.Helper()
+  count := -1
+  db.View(func(tx *Tx) error {
+    chirp, ok := tx.Chirp(id)
+    if !ok {
+      t.Fatalf("chirp %d is gone", id)
+    }
+    count = chirp.ReplyCount
+    return nil
+  })
+  return count
+}
+
+// trashedAgo backdates when chirp id went into the trash
+func trashedAgo(t *testing.T, db *DB, id int, ago time.Duration) {
+  t.Helper()
+  err := db.Update(func(tx *Tx) error {
+    chirp, _ := tx.Chirp(id)
+    deletedAt := now().Add(-ago)
+    chirp.DeletedAt = &deletedAt
+    return tx.PutChirp(chirp)
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestTrashAndRestore(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  reply := createReply(t, db, bob, root.ID, "reply")
+
+  if _, err := db.TrashChirp(reply.ID, alice); err != errNotChirpAuthor {
+    t.Fatalf("trashing someone else's chirp = %v", err)
+  }
+  _, err = db.TrashChirp(reply.ID, bob)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.GetChirp(reply.ID); err == nil {
+    t.Fatal("a trashed chirp is still served")
+  }
+  if trash, _ := db.GetTrash(bob.ID); len(trash) != 1 || trash[0].ID != reply.ID {
+    t.Fatalf("bob's trash = %v", chirpIDs(trash))
+  }
+  if n := replyCount(t, db, root.ID); n != 0 {
+    t.Fatalf("root counts %d replies with its only one in the trash", n)
+  }
+  if _, err := db.TrashChirp(reply.ID, bob); err == nil {
+    t.Fatal("trashed a chirp twice")
+  }
+
+  if _, err := db.RestoreChirp(reply.ID, alice, time.Hour); err != errNotChirpAuthor {
+    t.Fatalf("restoring someone else's chirp = %v", err)
+  }
+  _, err = db.RestoreChirp(reply.ID, bob, time.Hour)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.GetChirp(reply.ID); err != nil {
+    t.Fatal(err)
+  }
+  if trash, _ := db.GetTrash(bob.ID); len(trash) != 0 {
+    t.Fatalf("bob's trash after restoring = %v", chirpIDs(trash))
+  }
+  if n := replyCount(t, db, root.ID); n != 1 {
+    t.Fatalf("root counts %d replies after restoring, want 1", n)
+  }
+
+  // the retention is over even if the janitor has not been yet
+  db.TrashChirp(reply.ID, bob)
+  trashedAgo(t, db, reply.ID, 2*time.Hour)
+  if _, err := db.RestoreChirp(reply.ID, bob, time.Hour); err == nil {
+    t.Fatal("restored a chirp past its retention")
+  }
+}
+
+func TestPurgeTrash(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  expired := createReply(t, db, bob, root.ID, "expired")
+  recent := createReply(t, db, bob, root.ID, "recent")
+  createReply(t, db, bob, root.ID, "stays")
+  // a trashed chirp with a reply of its own
+  parent := createChirps(t, db, alice, "parent")[0]
+  below := createReply(t, db, bob, parent.ID, "below")
+
+  for _, id := range []int{expired.ID, recent.ID} {
+    db.TrashChirp(id, bob)
+  }
+  db.TrashChirp(parent.ID, alice)
+  trashedAgo(t, db, expired.ID, 48*time.Hour)
+  trashedAgo(t, db, parent.ID, 48*time.Hour)
+  if n := replyCount(t, db, root.ID); n != 1 {
+    t.Fatalf("root counts %d replies, want 1", n)
+  }
+
+  purged, err := db.PurgeTrash(now().Add(-24 * time.Hour))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if purged != 2 {
+    t.Fatalf("purged %d chirps, want 2", purged)
+  }
+  // what was in the trash did not count, so purging it changes nothing
+  if n := replyCount(t, db, root.ID); n != 1 {
+    t.Fatalf("root counts %d replies after purging, want 1", n)
+  }
+  if trash, _ := db.GetTrash(bob.ID); len(trash) != 1 || trash[0].ID != recent.ID {
+    t.Fatalf("bob's trash after purging = %v", chirpIDs(trash))
+  }
+  if trash, _ := db.GetTrash(alice.ID); len(trash) != 0 {
+    t.Fatalf("alice's trash after purging = %v", chirpIDs(trash))
+  }
+  if _, err := db.RestoreChirp(expired.ID, bob, time.Hour*100); err == nil {
+    t.Fatal("restored a purged chirp")
+  }
+  // the purged parent stays in its thread as a tombstone
+  if got := threadIDs(t, db, below.ID); got != "[5] 6 []" {
+    t.Fatalf("thread below the purged parent = %s", got)
+  }
+
+  // once its last reply is deleted the tombstone goes too
+  err = db.DeleteChrip(below)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.GetThread(parent.ID); err == nil {
+    t.Fatal("the tombstone outlived its last reply")
+  }
+  if purged, _ := db.PurgeTrash(now().Add(-24 * time.Hour)); purged != 0 {
+    t.Fatalf("purging again purged %d chirps", purged)
+  }
+}
+
+func TestTrashingTheLastReplyOfATombstone(t *testing.T) {
+  db, err := NewMemoryDB()
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice, _ := db.CreateUser("alice@example.com", "hunter2")
+  bob, _ := db.CreateUser("bob@example.com", "hunter2")
+  root := createChirps(t, db, alice, "root")[0]
+  middle := createReply(t, db, alice, root.ID, "middle")
+  reply := createReply(t, db, bob, middle.ID, "reply")
+  err = db.DeleteChrip(middle)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = db.TrashChirp(reply.ID, bob)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // nothing visible hangs off the tombstone anymore
+  if _, err := db.GetThread(middle.ID); err == nil {
+    t.Fatal("the tombstone outlived its last reply")
+  }
+  if n := replyCount(t, db, root.ID); n != 0 {
+    t.Fatalf("root counts %d replies, want 0", n)
+  }
+  // the reply comes back without its parent
+  restored, err := db.RestoreChirp(reply.ID, bob, time.Hour)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := threadIDs(t, db, restored.ID); got != "[] 3 []" {
+    t.Fatalf("thread of the restored reply = %s", got)
+  }
+}
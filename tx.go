@@ -0,0 +1,192 @@
+package main
+
+import (
+  "errors"
+)
+
+var errReadOnlyTx = errors.New("cannot write in a read-only transaction")
+
+// Tx is one read-modify-write session on the database. the DB lock is held
+// for its whole lifetime, so nothing can change between what a transaction
+// reads and what it writes. writes go straight to the cache (and its indexes)
+// and are handed to the storage as a single batch once the Update function
+// returns nil; on any error they are undone again
+type Tx struct {
+  db       *DB
+  muts     []mutation
+  undo     []mutation
+  writable bool
+}
+
+// Update runs fn in a writable transaction; if fn returns an error nothing is written
+func (db *DB) Update(fn func(tx *Tx) error) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  return db.update(fn)
+}
+
+// update is Update for callers that already hold the write lock
+func (db *DB) update(fn func(tx *Tx) error) error {
+  tx := &Tx{db: db, writable: true}
+  err := fn(tx)
+  if err == nil && len(tx.muts) > 0 {
+    err = db.storage.apply(tx.muts)
+  }
+  if err != nil {
+    tx.rollback()
+    return err
+  }
+  return nil
+}
+
+// View runs fn in a read-only transaction; any number of them can run at once
+func (db *DB) View(fn func(tx *Tx) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+
+  return fn(&Tx{db: db})
+}
+
+func (tx *Tx) write(m mutation) error {
+  if !tx.writable {
+    return errReadOnlyTx
+  }
+  undo, err := tx.db.applyIndexed(m)
+  if err != nil {
+    return err
+  }
+  tx.muts = append(tx.muts, m)
+  tx.undo = append(tx.undo, undo)
+  return nil
+}
+
+func (tx *Tx) rollback() {
+  for i := len(tx.undo) - 1; i >= 0; i-- {
+    tx.db.applyIndexed(tx.undo[i])
+  }
+  tx.muts = nil
+  tx.undo = nil
+}
+
+// applyIndexed applies m to the cache, keeping the indexes in step, and
+// returns the mutation that puts things back the way they were
+func (db *DB) applyIndexed(m mutation) (mutation, error) {
+  t, err := findTable(m.table)
+  if err != nil {
+    return mutation{}, err
+  }
+
+  prev := t.get(&db.data, m.key)
+  if prev != nil {
+    db.idx.remove(m.table, prev)
+  }
+  if m.value == nil {
+    err = t.del(&db.data, m.key)
+  } else {
+    err = t.put(&db.data, m.key, m.value)
+  }
+  if err != nil {
+    if prev != nil {
+      db.idx.add(m.table, prev)
+    }
+    return mutation{}, err
+  }
+  if current := t.get(&db.data, m.key); current != nil {
+    db.idx.add(m.table, current)
+  }
+
+  return mutation{table: m.table, key: m.key, value: prev}, nil
+}
+
+// NextID reserves the next id of tableName, see DBStructure.nextID
+func (tx *Tx) NextID(tableName string) (int, error) {
+  id := tx.db.data.nextID(tableName)
+  err := tx.write(putNamedRecord("sequences", tableName, id))
+  if err != nil {
+    return 0, err
+  }
+  return id, nil
+}
+
+func (tx *Tx) Chirp(id int) (Chirp, bool) {
+  chirp, ok := tx.db.data.Chirps[id]
+  return chirp, ok
+}
+
+// Chirps returns every chirp, in no particular order; hidden ones (see
+// Chirp.hidden) are left out
+func (tx *Tx) Chirps() []Chirp {
+  chirps := make([]Chirp, 0, len(tx.db.data.Chirps))
+  for _, chirp := range tx.db.data.Chirps {
+    if !chirp.hidden() {
+      chirps = append(chirps, chirp)
+    }
+  }
+  return chirps
+}
+
+// ChirpsByAuthor returns every chirp of one author, in no particular order
+func (tx *Tx) ChirpsByAuthor(authorId int) []Chirp {
+  ids := tx.db.idx.chirpsByAuthor[authorId]
+  chirps := make([]Chirp, 0, len(ids))
+  for id := range ids {
+    chirps = append(chirps, tx.db.data.Chirps[id])
+  }
+  return chirps
+}
+
+// PutChirp stores the chirp and, next to it, its moderation flags
+func (tx *Tx) PutChirp(chirp Chirp) error {
+  err := tx.write(putRecord("chirps", chirp.ID, chirp))
+  if err != nil {
+    return err
+  }
+  return tx.putChirpFlags(chirp.ID, chirp.ModerationFlags)
+}
+
+func (tx *Tx) DeleteChirp(id int) error {
+  err := tx.write(deleteRecord("chirps", id))
+  if err != nil {
+    return err
+  }
+  return tx.putChirpFlags(id, nil)
+}
+
+func (tx *Tx) User(id int) (User, bool) {
+  user, ok := tx.db.data.Users[id]
+  return user, ok
+}
+
+// Users returns every user, in no particular order
+func (tx *Tx) Users() []User {
+  users := make([]User, 0, len(tx.db.data.Users))
+  for _, user := range tx.db.data.Users {
+    users = append(users, user)
+  }
+  return users
+}
+
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+  return tx.userByIndex(tx.db.idx.userByEmail, email)
+}
+
+func (tx *Tx) UserByAccessToken(accessToken string) (User, bool) {
+  return tx.userByIndex(tx.db.idx.userByAccessToken, accessToken)
+}
+
+func (tx *Tx) UserByRefreshToken(refreshToken string) (User, bool) {
+  return tx.userByIndex(tx.db.idx.userByRefreshToken, refreshToken)
+}
+
+func (tx *Tx) userByIndex(index map[string]int, key string) (User, bool) {
+  id, ok := index[key]
+  if !ok {
+    return User{}, false
+  }
+  return tx.User(id)
+}
+
+func (tx *Tx) PutUser(user User) error {
+  return tx.write(putRecord("users", user.ID, user))
+}
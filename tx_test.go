@@ -0,0 +1,98 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "path/filepath"
+  "sync"
+  "testing"
+)
+
+// run with -race: every writer goes through Update, so none of them may
+// lose a chirp or share an id with another, whatever the storage
+func TestConcurrentCreateChirp(t *testing.T) {
+  const writers = 8
+  const chirpsEach = 25
+
+  for _, name := range []string{"memory", "database.json", "database.db"} {
+    t.Run(name, func(t *testing.T) {
+      var db *DB
+      var err error
+      if name == "memory" {
+        db, err = NewMemoryDB()
+      } else {
+        db, err = NewDB(filepath.Join(t.TempDir(), name))
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if closer, ok := db.storage.(io.Closer); ok {
+        defer closer.Close()
+      }
+      author, err := db.CreateUser("alice@example.com", "hunter2")
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      var wg sync.WaitGroup
+      created := make(chan Chirp, writers*chirpsEach)
+      errs := make(chan error, writers*chirpsEach)
+      for w := 0; w < writers; w++ {
+        wg.Add(1)
+        go func(w int) {
+          defer wg.Done()
+          for i := 0; i < chirpsEach; i++ {
+            chirp, err := db.CreateChirp(Chirp{Body: fmt.Sprintf("chirp %d from writer %d", i, w)}, author)
+            if err != nil {
+              errs <- err
+              return
+            }
+            created <- chirp
+          }
+        }(w)
+      }
+      // readers at the same time, so the race detector sees them too
+      for r := 0; r < 2; r++ {
+        wg.Add(1)
+        go func() {
+          defer wg.Done()
+          for i := 0; i < chirpsEach; i++ {
+            if _, err := db.GetChirps(); err != nil {
+              errs <- err
+              return
+            }
+          }
+        }()
+      }
+      wg.Wait()
+      close(created)
+      close(errs)
+      for err := range errs {
+        t.Fatal(err)
+      }
+
+      ids := map[int]string{}
+      for chirp := range created {
+        if body, ok := ids[chirp.ID]; ok {
+          t.Fatalf("%q and %q both got id %d", body, chirp.Body, chirp.ID)
+        }
+        ids[chirp.ID] = chirp.Body
+      }
+      if len(ids) != writers*chirpsEach {
+        t.Fatalf("created %d chirps, want %d", len(ids), writers*chirpsEach)
+      }
+      stored, err := db.GetChirps()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(stored) != writers*chirpsEach {
+        t.Fatalf("stored %d chirps, want %d", len(stored), writers*chirpsEach)
+      }
+      for _, chirp := range stored {
+        if ids[chirp.ID] != chirp.Body {
+          t.Fatalf("chirp %d is %q, was created as %q", chirp.ID, chirp.Body, ids[chirp.ID])
+        }
+      }
+    })
+  }
+}
@@ -6,43 +6,49 @@ import (
   "sort"
   "strconv"
   "errors"
+  "time"
 )
 
 type UserResponse struct {
   Email string `json:"email"`
   ID int `json:"id"`
   IsChirpyRed bool `json:"is_chirpy_red"`
+  CreatedAt time.Time `json:"created_at"`
+  UpdatedAt time.Time `json:"updated_at"`
+  Handle string `json:"handle,omitempty"`
+  Role string `json:"role"`
 }
 
-func (cfg *apiConfig) findUserByEmail(email string) (User, error) {
-  dbUsers, err := cfg.DB.GetUsers()
-  if err != nil {
-    return User{}, err
-  }
-  
-  for _, dbUser := range dbUsers {
-    if dbUser.Email == email {
-      return dbUser, nil
-    }
+func newUserResponse(user User) UserResponse {
+  return UserResponse{
+    Handle: user.Handle,
+    Role: user.Role,
+    Email: user.Email,
+    ID:   user.ID,
+    IsChirpyRed: user.Subscription.plan(now()) == planRed,
+    CreatedAt: user.CreatedAt,
+    UpdatedAt: user.UpdatedAt,
   }
+}
 
-  return User{}, nil
+func (cfg *apiConfig) findUserByEmail(email string) (User, error) {
+  return cfg.DB.FindUserByEmail(email)
 }
 
 func (cfg *apiConfig) findUserById(id int) (User, error) {
-  dbUsers, err := cfg.DB.GetUsers()
+  dbUser, err := cfg.DB.GetUser(id)
   if err != nil {
     return User{}, err
   }
 
-  // equivalent to saying the id exceeds available chirps
-  if len(dbUsers) < id {
-    return User{}, errors.New("user not found")
-  }
-
   user := User{
-    ID: dbUsers[id-1].ID,
-    Email: dbUsers[id-1].Email,
+    ID: dbUser.ID,
+    Email: dbUser.Email,
+    Handle: dbUser.Handle,
+    Role: dbUser.Role,
+    Subscription: dbUser.Subscription,
+    CreatedAt: dbUser.CreatedAt,
+    UpdatedAt: dbUser.UpdatedAt,
   }
 
   return user, nil
@@ -61,10 +67,28 @@ func (cfg *apiConfig) validateUserEmail(email string) (error) {
   return nil
 }
 
+func (cfg *apiConfig) validateUserHandle(handle string, userId int) (error) {
+  err := validateHandle(handle)
+  if err != nil {
+    return err
+  }
+
+  user, err := cfg.DB.FindUserByHandle(handle)
+  if err != nil {
+    return err
+  }
+  if user.ID != 0 && user.ID != userId {
+    return errHandleTaken
+  }
+
+  return nil
+}
+
 func (cfg *apiConfig) handlerUserCreate(w http.ResponseWriter, r *http.Request) {
   type parameters struct {
     Email string `json:"email"`
     Password string `json:"password"`
+    Handle string `json:"handle"`
   }
 
   decoder := json.NewDecoder(r.Body)
@@ -81,18 +105,28 @@ func (cfg *apiConfig) handlerUserCreate(w http.ResponseWriter, r *http.Request)
     respondWithError(w, http.StatusBadRequest, emailErr.Error())
     return
   }
+  if params.Handle != "" {
+    handleErr := cfg.validateUserHandle(params.Handle, 0)
+    if handleErr != nil {
+      respondWithError(w, http.StatusBadRequest, handleErr.Error())
+      return
+    }
+  }
 
   user, err := cfg.DB.CreateUser(params.Email, params.Password)
   if err != nil {
     respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
     return
   }
+  if params.Handle != "" {
+    user, err = cfg.DB.SetUserHandle(user.ID, params.Handle)
+    if err != nil {
+      respondWithError(w, http.StatusBadRequest, err.Error())
+      return
+    }
+  }
 
-  respondWithJSON(w, http.StatusCreated, UserResponse{
-    Email: user.Email,
-    ID:   user.ID,
-    IsChirpyRed: user.IsChirpyRed,
-  })
+  respondWithJSON(w, http.StatusCreated, newUserResponse(user))
 }
 
 func (cfg *apiConfig) handlerUsersRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -131,7 +165,7 @@ func (cfg *apiConfig) handlerUsersRetrieveById(w http.ResponseWriter, r *http.Re
     return
   }
 
-  respondWithJSON(w, http.StatusOK, user)
+  respondWithJSON(w, http.StatusOK, newUserResponse(user))
 }
 
 func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) {
@@ -140,9 +174,7 @@ func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) {
     Password string `json:"password"`
   }
   type UserResponseWithTokens struct {
-    Email string `json:"email"`
-    ID int `json:"id"`
-    IsChirpyRed bool `json:"is_chirpy_red"`
+    UserResponse
     Token string `json:"token"`
     Refresh_Token string `json:"refresh_token"`
   }
@@ -168,8 +200,12 @@ func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) {
     respondWithError(w, http.StatusUnauthorized, passErr.Error())
     return
   }
+  if user.suspended(now()) {
+    respondWithError(w, http.StatusForbidden, suspensionError(user).Error())
+    return
+  }
 
-  accessToken, TokenErr := cfg.jwtCreateAccessToken(user.ID)
+  accessToken, TokenErr := cfg.jwtCreateAccessToken(user.ID, user.Role)
   if TokenErr != nil {
     respondWithError(w, http.StatusInternalServerError, TokenErr.Error())
     return
@@ -183,9 +219,7 @@ func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) {
   cfg.DB.SetUserTokens(user.ID, accessToken, refreshToken)
 
   respondWithJSON(w, http.StatusOK, UserResponseWithTokens{
-    Email: user.Email,
-    ID:   user.ID,
-    IsChirpyRed: user.IsChirpyRed,
+    UserResponse: newUserResponse(user),
     Token: accessToken,
     Refresh_Token: refreshToken,
   })
@@ -195,15 +229,20 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
   type parameters struct {
     Password string `json:"password"`
     Email    string `json:"email"`
+    // left out means the handle stays as it is
+    Handle   string `json:"handle"`
   }
   type UserResponse struct {
     Email string `json:"email"`
     ID int `json:"id"`
+    Handle string `json:"handle,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
   }
 
-  token, err := GetBearerToken(r.Header)
+  token, err := cfg.validateToken(r, "chirpy-access")
   if err != nil {
-    respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
+    respondWithError(w, http.StatusUnauthorized, err.Error())
     return
   }
   subject, err := ValidateJWT(token, cfg.jwtSecret)
@@ -212,16 +251,6 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
     return
   }
 
-  issuer, errI := GetIssuer(token, cfg.jwtSecret)
-  if errI != nil {
-    respondWithError(w, http.StatusUnauthorized, "Coulnd't validate Issuer")
-    return
-  }
-  if issuer == "chirpy-refresh" {
-    respondWithError(w, http.StatusUnauthorized, "Cannot use refresh token for this entry point")
-    return
-  }
-
   decoder := json.NewDecoder(r.Body)
   params := parameters{}
   err = decoder.Decode(&params)
@@ -242,14 +271,32 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
     return
   }
 
+  if params.Handle != "" {
+    handleErr := cfg.validateUserHandle(params.Handle, userIDInt)
+    if handleErr != nil {
+      respondWithError(w, http.StatusBadRequest, handleErr.Error())
+      return
+    }
+  }
+
   user, err := cfg.DB.UpdateUser(userIDInt, params.Email, hashedPassword)
   if err != nil {
     respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
     return
   }
+  if params.Handle != "" {
+    user, err = cfg.DB.SetUserHandle(userIDInt, params.Handle)
+    if err != nil {
+      respondWithError(w, http.StatusBadRequest, err.Error())
+      return
+    }
+  }
 
   respondWithJSON(w, http.StatusOK, UserResponse{
     ID:    user.ID,
     Email: user.Email,
+    Handle: user.Handle,
+    CreatedAt: user.CreatedAt,
+    UpdatedAt: user.UpdatedAt,
   })
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// after this many logged batches the wal is folded back into the snapshot
+const walCompactEvery = 1000
+
+// walRecord is one line of the wal: every mutation of a single apply call,
+// so a batch is either replayed completely or not at all
+type walRecord struct {
+  Mutations []walMutation `json:"mutations"`
+}
+
+type walMutation struct {
+  Table string          `json:"table"`
+  Key   string          `json:"key"`
+  Value json.RawMessage `json:"value,omitempty"`
+}
+
+func encodeWALRecord(muts []mutation) ([]byte, error) {
+  record := walRecord{Mutations: make([]walMutation, 0, len(muts))}
+  for _, m := range muts {
+    wm := walMutation{Table: m.table, Key: m.key}
+    if m.value != nil {
+      dat, err := json.Marshal(m.value)
+      if err != nil {
+        return nil, err
+      }
+      wm.Value = dat
+    }
+    record.Mutations = append(record.Mutations, wm)
+  }
+  dat, err := json.Marshal(record)
+  if err != nil {
+    return nil, err
+  }
+  return append(dat, '\n'), nil
+}
+
+func (r walRecord) mutations() []mutation {
+  muts := make([]mutation, 0, len(r.Mutations))
+  for _, wm := range r.Mutations {
+    m := mutation{table: wm.Table, key: wm.Key}
+    if wm.Value != nil {
+      m.value = wm.Value
+    }
+    muts = append(muts, m)
+  }
+  return muts
+}
+
+// errStaleWALRecord marks a record from before the last compaction that
+// the snapshot already contains, see jsonFileStorage.decodeWALLine
+var errStaleWALRecord = errors.New("stale wal record")
+
+// replayWAL applies every complete record of the wal at path to ds.
+// it returns the number of records and the offset where the valid log ends;
+// anything after that is a torn write from a crash and was never acknowledged.
+// only a last line without its newline can be torn: a complete line that does
+// not decode is corruption, and the records after it were acknowledged, so
+// that is an error rather than something to cut off
+func replayWAL(path string, ds *DBStructure, decode func(line []byte) (walRecord, error)) (int, int64, error) {
+  f, err := os.Open(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return 0, 0, nil
+  }
+  if err != nil {
+    return 0, 0, err
+  }
+  defer f.Close()
+
+  reader := bufio.NewReader(f)
+  records := 0
+  var offset int64
+  for lineNo := 1; ; lineNo++ {
+    line, err := reader.ReadBytes('\n')
+    if errors.Is(err, io.EOF) {
+      // a last line without its newline never finished writing
+      return records, offset, nil
+    }
+    if err != nil {
+      return records, offset, err
+    }
+
+    record, err := decode(bytes.TrimSpace(line))
+    if errors.Is(err, errStaleWALRecord) {
+      offset += int64(len(line))
+      continue
+    }
+    if err != nil {
+      return records, offset, fmt.Errorf("%s: line %d is corrupt: %w", path, lineNo, err)
+    }
+    err = applyMutations(ds, record.mutations())
+    if err != nil {
+      return records, offset, err
+    }
+    records++
+    offset += int64(len(line))
+  }
+}
+
+// writeFileAtomic replaces path with dat so that readers only ever see
+// the old or the new content: temp file, fsync, rename, fsync the directory
+func writeFileAtomic(path string, dat []byte) error {
+  dir := filepath.Dir(path)
+  tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+  if err != nil {
+    return err
+  }
+  tmpName := tmp.Name()
+  defer os.Remove(tmpName)
+
+  _, err = tmp.Write(dat)
+  if err == nil {
+    err = tmp.Chmod(0600)
+  }
+  if err == nil {
+    err = tmp.Sync()
+  }
+  closeErr := tmp.Close()
+  if err != nil {
+    return err
+  }
+  if closeErr != nil {
+    return closeErr
+  }
+
+  err = os.Rename(tmpName, path)
+  if err != nil {
+    return err
+  }
+  return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  return d.Sync()
+}